@@ -0,0 +1,135 @@
+package admin
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	_ "net/http/pprof" // registers /debug/pprof on http.DefaultServeMux
+	"time"
+
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/service"
+	"github.com/pires/metricas/timeseries"
+)
+
+func init() {
+	// served at /debug/vars along with memstats and cmdline
+	expvar.Publish("metricas", expvar.Func(func() interface{} {
+		return instrument.Default.Snapshot()
+	}))
+}
+
+// Returns a handler serving the admin endpoints of a metrics service:
+//
+//	/health       200 as long as the process is up
+//	/ready        200 when the service is ready to take metrics, 503 otherwise
+//	/metrics      internal measurements, as JSON
+//	/debug/pprof  runtime profiles, see net/http/pprof
+//	/debug/vars   exported variables, see expvar
+//
+// and the admin API:
+//
+//	POST   /admin/pause                   pauses writes, see MetricsService.Pause
+//	POST   /admin/resume                  resumes writes
+//	POST   /admin/flush                   writes buffered points right away
+//	GET    /admin/buffers                 points buffered by the queue and each destination
+//	GET    /admin/subscriptions           subjects metrics are consumed from
+//	POST   /admin/subscriptions?subject=  starts consuming from a subject
+//	DELETE /admin/subscriptions?subject=  stops consuming from a subject
+func NewHandler(svc *service.MetricsService) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := svc.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/metrics", instrument.Default)
+	mux.HandleFunc("/admin/pause", post(svc.Pause))
+	mux.HandleFunc("/admin/resume", post(svc.Resume))
+	mux.HandleFunc("/admin/flush", post(svc.Flush))
+	mux.HandleFunc("/admin/buffers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, buffers(svc.Stats(), time.Now()))
+	})
+	mux.HandleFunc("/admin/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		switch r.Method {
+		case "GET":
+		case "POST":
+			err = svc.Subscribe(r.FormValue("subject"))
+		case "DELETE":
+			err = svc.Unsubscribe(r.FormValue("subject"))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, svc.Subscriptions())
+	})
+	// pprof and expvar only register themselves on the default mux
+	mux.Handle("/debug/", http.DefaultServeMux)
+	return mux
+}
+
+// Returns a handler calling f on POST
+func post(f func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := f(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+type buffer struct {
+	Points    uint64 `json:"points"`
+	OldestAge string `json:"oldest_age,omitempty"`
+}
+
+type bufferStatus struct {
+	Paused       bool              `json:"paused"`
+	Queue        buffer            `json:"queue"`
+	Destinations map[string]buffer `json:"destinations"`
+}
+
+// Summarizes the points buffered along the way to each destination
+func buffers(stats service.Stats, now time.Time) *bufferStatus {
+	status := &bufferStatus{
+		Paused:       stats.Paused,
+		Queue:        buffer{Points: uint64(stats.Queue.Depth)},
+		Destinations: make(map[string]buffer),
+	}
+	destinations := stats.Backends
+	if destinations == nil {
+		destinations = map[string]timeseries.Stats{"sink": stats.Sink}
+	}
+	for name, s := range destinations {
+		b := buffer{Points: s.Buffered}
+		if !s.OldestBuffered.IsZero() {
+			b.OldestAge = now.Sub(s.OldestBuffered).String()
+		}
+		status.Destinations[name] = b
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false) // subjects may contain >
+	enc.Encode(v)
+}
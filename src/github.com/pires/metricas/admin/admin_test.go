@@ -0,0 +1,144 @@
+package admin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+
+	"github.com/pires/metricas/service"
+	"github.com/pires/metricas/timeseries"
+)
+
+func TestBuffers(t *testing.T) {
+	now := time.Unix(1434055562, 0)
+	tests := []struct {
+		name   string
+		stats  service.Stats
+		status *bufferStatus
+	}{
+		{
+			name:  "sink",
+			stats: service.Stats{Queue: service.QueueStats{Depth: 3}, Sink: timeseries.Stats{Buffered: 10, OldestBuffered: now.Add(-time.Minute)}},
+			status: &bufferStatus{
+				Queue:        buffer{Points: 3},
+				Destinations: map[string]buffer{"sink": {Points: 10, OldestAge: "1m0s"}},
+			},
+		},
+		{
+			name:  "empty sink",
+			stats: service.Stats{Paused: true},
+			status: &bufferStatus{
+				Paused:       true,
+				Destinations: map[string]buffer{"sink": {}},
+			},
+		},
+		{
+			name: "backends",
+			stats: service.Stats{
+				Sink: timeseries.Stats{Buffered: 12},
+				Backends: map[string]timeseries.Stats{
+					"influxdb": {Buffered: 12, OldestBuffered: now.Add(-90 * time.Second)},
+					"file":     {},
+				},
+			},
+			status: &bufferStatus{
+				Destinations: map[string]buffer{"influxdb": {Points: 12, OldestAge: "1m30s"}, "file": {}},
+			},
+		},
+	}
+	for _, test := range tests {
+		if status := buffers(test.stats, now); !reflect.DeepEqual(status, test.status) {
+			t.Errorf("%s: got %+v, want %+v", test.name, status, test.status)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := server.New(&server.Options{Host: "127.0.0.1", Port: server.RANDOM_PORT, NoSigs: true})
+	go s.Start()
+	defer s.Shutdown()
+	for deadline := time.Now().Add(5 * time.Second); s.Addr() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("NATS server not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dir, err := ioutil.TempDir("", "metricas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a fan-out sink, which can be paused
+	svc, err := service.NewMetricsService(&service.Configuration{
+		AddrNats: s.Addr().String(),
+		Sink: &timeseries.SinkConfiguration{
+			Type: timeseries.SINK_FANOUT,
+			Fanout: &timeseries.FanoutConfiguration{Sinks: []*timeseries.SinkConfiguration{{
+				Name: "file",
+				Type: timeseries.SINK_FILE,
+				File: &timeseries.FileConfiguration{Path: filepath.Join(dir, "points.lp")},
+			}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(svc)
+	if code, _ := serve(handler, "GET", "/ready"); code != http.StatusServiceUnavailable {
+		t.Errorf("ready before starting: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if err := svc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{"GET", "/health", http.StatusOK, "ok\n"},
+		{"GET", "/ready", http.StatusOK, "ok\n"},
+		{"GET", "/admin/pause", http.StatusMethodNotAllowed, "method not allowed\n"},
+		{"POST", "/admin/pause", http.StatusOK, "ok\n"},
+		{"GET", "/admin/buffers", http.StatusOK, `"paused": true`},
+		{"POST", "/admin/flush", http.StatusOK, "ok\n"},
+		{"POST", "/admin/resume", http.StatusOK, "ok\n"},
+		{"GET", "/admin/buffers", http.StatusOK, `"paused": false`},
+		{"GET", "/admin/subscriptions", http.StatusOK, "[\n  \"metrics\"\n]\n"},
+		{"POST", "/admin/subscriptions?subject=events.>", http.StatusOK, "[\n  \"events.>\",\n  \"metrics\"\n]\n"},
+		{"DELETE", "/admin/subscriptions?subject=events.>", http.StatusOK, "[\n  \"metrics\"\n]\n"},
+		{"DELETE", "/admin/subscriptions?subject=events.>", http.StatusBadRequest, "not subscribed to events.>\n"},
+		{"PUT", "/admin/subscriptions", http.StatusMethodNotAllowed, "method not allowed\n"},
+	}
+	for _, test := range tests {
+		code, body := serve(handler, test.method, test.path)
+		if code != test.code || !strings.Contains(body, test.body) {
+			t.Errorf("%s %s: got %d %q, want %d %q", test.method, test.path, code, body, test.code, test.body)
+		}
+	}
+
+	svc.Stop()
+	if err := svc.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := serve(handler, "POST", "/admin/pause"); code != http.StatusInternalServerError || body != service.ErrStopped.Error()+"\n" {
+		t.Errorf("pausing once stopped: got %d %q, want %d %q", code, body, http.StatusInternalServerError, service.ErrStopped.Error()+"\n")
+	}
+}
+
+func serve(handler http.Handler, method, path string) (int, string) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w.Code, w.Body.String()
+}
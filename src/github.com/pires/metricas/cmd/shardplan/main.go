@@ -0,0 +1,74 @@
+// Plans changes to the InfluxDB instances of the metricas shard sink.
+//
+// Series keys, one per line as listed by InfluxDB's SHOW SERIES, are read from
+// stdin, and those whose shards change between the current and the new list
+// of instances are printed along with the shards they move from and to.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+var (
+	from     = flag.String("from", "", "Current InfluxDB addresses (host:port,...), as passed to metricas -db")
+	to       = flag.String("to", "", "New InfluxDB addresses (host:port,...)")
+	vnodes   = flag.Int("vnodes", timeseries.HASH_RING_VIRTUAL_NODES, "Virtual nodes per InfluxDB, as passed to metricas -shard_vnodes")
+	replicas = flag.Int("replicas", 1, "InfluxDB instances every series is written to, as passed to metricas -shard_replicas")
+)
+
+func main() {
+	flag.Parse()
+	if *from == "" || *to == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	before := timeseries.NewHashRing(strings.Split(*from, ","), *vnodes)
+	after := timeseries.NewHashRing(strings.Split(*to, ","), *vnodes)
+
+	var total, moved int
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		series := strings.TrimSpace(scanner.Text())
+		if series == "" {
+			continue
+		}
+		total++
+		owners, newOwners := before.Get(series, *replicas), after.Get(series, *replicas)
+		if !sameOwners(owners, newOwners) {
+			moved++
+			fmt.Printf("%s\t%s\t%s\n", series, strings.Join(owners, ","), strings.Join(newOwners, ","))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalln(err)
+	}
+	if total > 0 {
+		log.Printf("%d of %d series (%.1f%%) change shards", moved, total, 100*float64(moved)/float64(total))
+	}
+}
+
+// Whether both lists hold the same instances, in any order, as replicas are
+// written alike wherever they are on the ring
+func sameOwners(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,508 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/nats-io/gnatsd/conf"
+
+	"github.com/pires/metricas/input"
+	"github.com/pires/metricas/natsserver"
+	"github.com/pires/metricas/pipeline"
+	"github.com/pires/metricas/processor"
+	"github.com/pires/metricas/service"
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	INFLUXDB_ADDR = "localhost:8086" // InfluxDB written to when left out, as by -db
+	INFLUXDB_DB   = "metrics"        // database written to when left out, as by -db_name
+)
+
+// Configuration file, in the format of gnatsd configuration files, e.g.
+//
+//	nats {
+//	  addr: "localhost:4222"
+//	  subjects: ["metrics"]
+//	}
+//	processors: [
+//	  {type: "filter", options {exclude: "debug_*"}}
+//	]
+//	sink {
+//	  type: "influxdb"
+//	  influxdb {addr: "localhost:8086", db: "metrics", flush_interval: "5s"}
+//	}
+//
+// Instead of a sink, points may be routed to several named outputs, see
+// pipeline.Configuration:
+//
+//	outputs: [
+//	  {name: "main", type: "influxdb", influxdb {addr: "localhost:8086"}}
+//	  {name: "archive", type: "file", file {path: "archive.lp"}}
+//	]
+//	routes: [
+//	  {match: ["metrics.billing.>"], outputs: ["archive"]}
+//	  {outputs: ["main", "archive"]}
+//	]
+//
+// Files starting with { are read as JSON instead. Settings left out take the same
+// defaults as the command-line flags.
+type Config struct {
+	NATS               NATS                    `json:"nats"`
+	EmbeddedNATS       *EmbeddedNATS           `json:"embedded_nats"`
+	Inputs             []*Input                `json:"inputs"`
+	Queue              Queue                   `json:"queue"`
+	Processors         []*Processor            `json:"processors"`
+	Sink               *Sink                   `json:"sink"`
+	Outputs            []*Sink                 `json:"outputs"`
+	Chains             map[string][]*Processor `json:"chains"`
+	Routes             []*Route                `json:"routes"`
+	HTTP               string                  `json:"http"`
+	ShutdownTimeout    Duration                `json:"shutdown_timeout"`
+	InstrumentInterval Duration                `json:"instrument_interval"`
+	ReadyQueueRatio    float64                 `json:"ready_queue_ratio"`
+}
+
+type NATS struct {
+	Addr          string   `json:"addr"`
+	Servers       []string `json:"servers"`
+	User          string   `json:"user"`
+	Password      string   `json:"password"`
+	Token         string   `json:"token"`
+	Secure        bool     `json:"secure"`
+	CACert        string   `json:"ca_cert"`
+	Cert          string   `json:"cert"`
+	Key           string   `json:"key"`
+	SkipVerify    bool     `json:"insecure_skip_verify"`
+	Name          string   `json:"name"`
+	ReconnectWait Duration `json:"reconnect_wait"`
+	MaxReconnect  int      `json:"max_reconnect"`
+	PingInterval  Duration `json:"ping_interval"`
+	Timeout       Duration `json:"timeout"`
+	Subjects      []string `json:"subjects"`
+}
+
+type EmbeddedNATS struct {
+	Addr     string `json:"addr"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	HTTPPort int    `json:"http_port"`
+}
+
+type Input struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Options map[string]string `json:"options"`
+}
+
+type Queue struct {
+	Size       int    `json:"size"`
+	Overflow   string `json:"overflow"`
+	SampleRate int    `json:"sample_rate"`
+}
+
+type Processor struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Options map[string]string `json:"options"`
+}
+
+type Sink struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	InfluxDB *InfluxDB         `json:"influxdb"`
+	File     *File             `json:"file"`
+	Fanout   *Fanout           `json:"fanout"`
+	Shard    *Shard            `json:"shard"`
+	Options  map[string]string `json:"options"`
+}
+
+type Route struct {
+	Match      []string `json:"match"`
+	Processors string   `json:"processors"`
+	Outputs    []string `json:"outputs"`
+}
+
+type InfluxDB struct {
+	Addr              string            `json:"addr"`
+	User              string            `json:"user"`
+	Password          string            `json:"password"`
+	DB                string            `json:"db"`
+	DatabaseTag       string            `json:"database_tag"`
+	FlushInterval     Duration          `json:"flush_interval"`
+	FlushMaxPoints    int               `json:"flush_max_points"`
+	RetentionPolicy   string            `json:"retention_policy"`
+	RetentionPolicies map[string]string `json:"retention_policies"`
+	Precision         string            `json:"precision"`
+	Consistency       string            `json:"consistency"`
+	WriteProtocol     string            `json:"write_protocol"`
+	MaxRetries        int               `json:"max_retries"`
+	RetryBackoff      Duration          `json:"retry_backoff"`
+	HTTPS             bool              `json:"https"`
+	CACert            string            `json:"ca_cert"`
+	SkipVerify        bool              `json:"insecure_skip_verify"`
+	Timeout           Duration          `json:"timeout"`
+	UserAgent         string            `json:"user_agent"`
+	DisableKeepAlives bool              `json:"disable_keep_alives"`
+	MaxIdleConns      int               `json:"max_idle_conns"`
+	IdleConnTimeout   Duration          `json:"idle_conn_timeout"`
+	StartupWait       Duration          `json:"startup_wait"`
+	Provision         *Provision        `json:"provision"`
+	FieldConflicts    string            `json:"field_conflicts"`
+	Quarantine        *Quarantine       `json:"quarantine"`
+	BreakerThreshold  int               `json:"breaker_threshold"`
+	BreakerCooldown   Duration          `json:"breaker_cooldown"`
+	AdaptiveLatency   Duration          `json:"adaptive_latency"`
+}
+
+// Quarantines publishing to a subject use the nats servers and credentials, or
+// the embedded NATS server, unless given their own
+type Quarantine struct {
+	Path       string   `json:"path"`
+	Subject    string   `json:"subject"`
+	Servers    []string `json:"servers"`
+	User       string   `json:"user"`
+	Password   string   `json:"password"`
+	Token      string   `json:"token"`
+	Secure     bool     `json:"secure"`
+	CACert     string   `json:"ca_cert"`
+	Cert       string   `json:"cert"`
+	Key        string   `json:"key"`
+	SkipVerify bool     `json:"insecure_skip_verify"`
+}
+
+type Provision struct {
+	RetentionPolicies []*RetentionPolicy `json:"retention_policies"`
+	Downsampling      []*Downsampling    `json:"downsampling"`
+	DryRun            bool               `json:"dry_run"`
+}
+
+type Downsampling struct {
+	Interval        Duration `json:"interval"`
+	RetentionPolicy string   `json:"retention_policy"`
+	Source          string   `json:"source"`
+	Function        string   `json:"function"`
+}
+
+// Data is kept forever when the duration is left out
+type RetentionPolicy struct {
+	Name        string   `json:"name"`
+	Duration    Duration `json:"duration"`
+	Replication int      `json:"replication"`
+	Default     bool     `json:"default"`
+}
+
+type File struct {
+	Path      string `json:"path"`
+	Precision string `json:"precision"`
+}
+
+type Fanout struct {
+	BufferSize int     `json:"buffer_size"`
+	Sinks      []*Sink `json:"sinks"`
+}
+
+type Shard struct {
+	VirtualNodes int     `json:"vnodes"`
+	Replicas     int     `json:"replicas"`
+	Sinks        []*Sink `json:"sinks"`
+}
+
+// A time.Duration written as a string, e.g. "1m30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Returns the configuration used for settings left out of a file
+func Default() *Config {
+	return &Config{
+		NATS: NATS{
+			Addr:     "localhost:4222",
+			Subjects: []string{service.SUBJECT},
+		},
+		InstrumentInterval: Duration(10 * time.Second),
+	}
+}
+
+// Reads and validates a configuration file
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+// Parses and validates a configuration
+func Parse(data string) (*Config, error) {
+	var m map[string]interface{}
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(data), "{") {
+		err = json.Unmarshal([]byte(data), &m)
+	} else {
+		m, err = conf.Parse(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// settings are checked against the structure, then decoded as JSON
+	v, err := normalize(m, reflect.TypeOf(Config{}), "")
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	config := Default()
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, err
+	}
+	if err := config.Service().Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Returns the configuration of the metrics service
+func (c *Config) Service() *service.Configuration {
+	config := &service.Configuration{
+		AddrNats: c.NATS.Addr,
+		NATS: &service.NATSConfiguration{
+			Servers:            c.NATS.Servers,
+			User:               c.NATS.User,
+			Password:           c.NATS.Password,
+			Token:              c.NATS.Token,
+			Secure:             c.NATS.Secure,
+			CACert:             c.NATS.CACert,
+			Cert:               c.NATS.Cert,
+			Key:                c.NATS.Key,
+			InsecureSkipVerify: c.NATS.SkipVerify,
+			Name:               c.NATS.Name,
+			ReconnectWait:      time.Duration(c.NATS.ReconnectWait),
+			MaxReconnect:       c.NATS.MaxReconnect,
+			PingInterval:       time.Duration(c.NATS.PingInterval),
+			Timeout:            time.Duration(c.NATS.Timeout),
+		},
+		Subjects: c.NATS.Subjects,
+		Queue: &service.QueueConfiguration{
+			Size:           c.Queue.Size,
+			OverflowPolicy: c.Queue.Overflow,
+			SampleRate:     c.Queue.SampleRate,
+		},
+		ShutdownTimeout:    time.Duration(c.ShutdownTimeout),
+		InstrumentInterval: time.Duration(c.InstrumentInterval),
+		ReadyQueueRatio:    c.ReadyQueueRatio,
+	}
+	if c.EmbeddedNATS != nil {
+		config.EmbeddedNATS = &natsserver.Configuration{
+			Addr:     c.EmbeddedNATS.Addr,
+			User:     c.EmbeddedNATS.User,
+			Password: c.EmbeddedNATS.Password,
+			HTTPPort: c.EmbeddedNATS.HTTPPort,
+		}
+	}
+	for _, in := range c.Inputs {
+		config.Inputs = append(config.Inputs, &input.Configuration{
+			Name:    in.Name,
+			Type:    in.Type,
+			Options: in.Options,
+		})
+	}
+	config.Processors = processors(c.Processors)
+	if c.Sink != nil {
+		config.Sink = c.Sink.configuration()
+		c.defaultQuarantine(config.Sink)
+	}
+	if len(c.Outputs) > 0 || len(c.Routes) > 0 {
+		config.Pipeline = &pipeline.Configuration{
+			Chains: make(map[string][]*processor.Configuration, len(c.Chains)),
+		}
+		for _, output := range c.Outputs {
+			config.Pipeline.Outputs = append(config.Pipeline.Outputs, output.configuration())
+			c.defaultQuarantine(config.Pipeline.Outputs[len(config.Pipeline.Outputs)-1])
+		}
+		for name, chain := range c.Chains {
+			config.Pipeline.Chains[name] = processors(chain)
+		}
+		for _, r := range c.Routes {
+			config.Pipeline.Routes = append(config.Pipeline.Routes, &pipeline.RouteConfiguration{
+				Match:      r.Match,
+				Processors: r.Processors,
+				Outputs:    r.Outputs,
+			})
+		}
+	}
+	return config
+}
+
+// Has quarantines of the sink, and of those it writes to, publish through the
+// nats servers, or the embedded one, unless given their own
+func (c *Config) defaultQuarantine(sink *timeseries.SinkConfiguration) {
+	if sink.InfluxDB != nil {
+		if q := sink.InfluxDB.Quarantine; q != nil && q.Subject != "" && len(q.Servers) == 0 {
+			if c.EmbeddedNATS != nil {
+				// which authenticates with neither tokens nor TLS
+				embedded := &natsserver.Configuration{Addr: c.EmbeddedNATS.Addr}
+				embedded.Validate() // validated along with the service
+				q.Servers = []string{embedded.ClientAddr()}
+				q.User, q.Password = c.EmbeddedNATS.User, c.EmbeddedNATS.Password
+			} else {
+				q.Servers = c.NATS.Servers
+				if len(q.Servers) == 0 {
+					q.Servers = []string{c.NATS.Addr}
+				}
+				q.User, q.Password, q.Token = c.NATS.User, c.NATS.Password, c.NATS.Token
+				q.Secure, q.InsecureSkipVerify = c.NATS.Secure, c.NATS.SkipVerify
+				q.CACert, q.Cert, q.Key = c.NATS.CACert, c.NATS.Cert, c.NATS.Key
+			}
+		}
+	}
+	var sinks []*timeseries.SinkConfiguration
+	if sink.Fanout != nil {
+		sinks = append(sinks, sink.Fanout.Sinks...)
+	}
+	if sink.Shard != nil {
+		sinks = append(sinks, sink.Shard.Sinks...)
+	}
+	for _, s := range sinks {
+		c.defaultQuarantine(s)
+	}
+}
+
+func processors(ps []*Processor) []*processor.Configuration {
+	var configs []*processor.Configuration
+	for _, p := range ps {
+		configs = append(configs, &processor.Configuration{
+			Name:    p.Name,
+			Type:    p.Type,
+			Options: p.Options,
+		})
+	}
+	return configs
+}
+
+func (s *Sink) configuration() *timeseries.SinkConfiguration {
+	config := &timeseries.SinkConfiguration{
+		Name:    s.Name,
+		Type:    s.Type,
+		Options: s.Options,
+	}
+	if s.InfluxDB == nil && s.Type == timeseries.SINK_INFLUXDB {
+		s.InfluxDB = &InfluxDB{}
+	}
+	if s.InfluxDB != nil {
+		if s.InfluxDB.Addr == "" {
+			s.InfluxDB.Addr = INFLUXDB_ADDR
+		}
+		if s.InfluxDB.DB == "" {
+			s.InfluxDB.DB = INFLUXDB_DB
+		}
+		config.InfluxDB = &timeseries.InfluxDBConfiguration{
+			AddrInfluxDb:       s.InfluxDB.Addr,
+			DbUser:             s.InfluxDB.User,
+			DbPwd:              s.InfluxDB.Password,
+			DbName:             s.InfluxDB.DB,
+			DatabaseTag:        s.InfluxDB.DatabaseTag,
+			FlushInterval:      time.Duration(s.InfluxDB.FlushInterval),
+			FlushMaxPoints:     s.InfluxDB.FlushMaxPoints,
+			RetentionPolicy:    s.InfluxDB.RetentionPolicy,
+			RetentionPolicies:  s.InfluxDB.RetentionPolicies,
+			Precision:          s.InfluxDB.Precision,
+			WriteConsistency:   s.InfluxDB.Consistency,
+			WriteProtocol:      s.InfluxDB.WriteProtocol,
+			MaxRetries:         s.InfluxDB.MaxRetries,
+			RetryBackoff:       time.Duration(s.InfluxDB.RetryBackoff),
+			HTTPS:              s.InfluxDB.HTTPS,
+			CACert:             s.InfluxDB.CACert,
+			InsecureSkipVerify: s.InfluxDB.SkipVerify,
+			Timeout:            time.Duration(s.InfluxDB.Timeout),
+			UserAgent:          s.InfluxDB.UserAgent,
+			DisableKeepAlives:  s.InfluxDB.DisableKeepAlives,
+			MaxIdleConns:       s.InfluxDB.MaxIdleConns,
+			IdleConnTimeout:    time.Duration(s.InfluxDB.IdleConnTimeout),
+			StartupWait:        time.Duration(s.InfluxDB.StartupWait),
+			FieldConflicts:     s.InfluxDB.FieldConflicts,
+			BreakerThreshold:   s.InfluxDB.BreakerThreshold,
+			BreakerCooldown:    time.Duration(s.InfluxDB.BreakerCooldown),
+			AdaptiveLatency:    time.Duration(s.InfluxDB.AdaptiveLatency),
+		}
+		if q := s.InfluxDB.Quarantine; q != nil {
+			config.InfluxDB.Quarantine = &timeseries.QuarantineConfiguration{
+				Path:               q.Path,
+				Subject:            q.Subject,
+				Servers:            q.Servers,
+				User:               q.User,
+				Password:           q.Password,
+				Token:              q.Token,
+				Secure:             q.Secure,
+				CACert:             q.CACert,
+				Cert:               q.Cert,
+				Key:                q.Key,
+				InsecureSkipVerify: q.SkipVerify,
+			}
+		}
+		if p := s.InfluxDB.Provision; p != nil {
+			config.InfluxDB.Provision = &timeseries.ProvisionConfiguration{DryRun: p.DryRun}
+			for _, rp := range p.RetentionPolicies {
+				config.InfluxDB.Provision.RetentionPolicies = append(config.InfluxDB.Provision.RetentionPolicies, &timeseries.RetentionPolicyConfiguration{
+					Name:        rp.Name,
+					Duration:    time.Duration(rp.Duration),
+					Replication: rp.Replication,
+					Default:     rp.Default,
+				})
+			}
+			for _, tier := range p.Downsampling {
+				config.InfluxDB.Provision.Downsampling = append(config.InfluxDB.Provision.Downsampling, &timeseries.DownsamplingConfiguration{
+					Interval:        time.Duration(tier.Interval),
+					RetentionPolicy: tier.RetentionPolicy,
+					Source:          tier.Source,
+					Function:        tier.Function,
+				})
+			}
+		}
+	}
+	if s.File != nil {
+		config.File = &timeseries.FileConfiguration{
+			Path:      s.File.Path,
+			Precision: s.File.Precision,
+		}
+	}
+	if s.Fanout != nil {
+		config.Fanout = &timeseries.FanoutConfiguration{
+			BufferSize: s.Fanout.BufferSize,
+		}
+		for _, backend := range s.Fanout.Sinks {
+			config.Fanout.Sinks = append(config.Fanout.Sinks, backend.configuration())
+		}
+	}
+	if s.Shard != nil {
+		config.Shard = &timeseries.ShardConfiguration{
+			VirtualNodes:      s.Shard.VirtualNodes,
+			ReplicationFactor: s.Shard.Replicas,
+		}
+		for _, shard := range s.Shard.Sinks {
+			config.Shard.Sinks = append(config.Shard.Sinks, shard.configuration())
+		}
+	}
+	return config
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+func TestParseInfluxDBDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		addr string
+		db   string
+	}{
+		{"without influxdb", `sink {type: "influxdb"}`, INFLUXDB_ADDR, INFLUXDB_DB},
+		{"empty influxdb", `sink {type: "influxdb", influxdb {}}`, INFLUXDB_ADDR, INFLUXDB_DB},
+		{"without db", `sink {type: "influxdb", influxdb {addr: "influxdb:8086"}}`, "influxdb:8086", INFLUXDB_DB},
+		{"given", `sink {type: "influxdb", influxdb {addr: "influxdb:8086", db: "app"}}`, "influxdb:8086", "app"},
+		{"json", `{"sink": {"type": "influxdb", "influxdb": {"db": "app"}}}`, INFLUXDB_ADDR, "app"},
+	}
+	for _, test := range tests {
+		c, err := Parse(test.data)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		influxDB := c.Service().Sink.InfluxDB
+		if influxDB.AddrInfluxDb != test.addr || influxDB.DbName != test.db {
+			t.Errorf("%s: got InfluxDB %s, database %q, want %s, %q", test.name, influxDB.AddrInfluxDb, influxDB.DbName, test.addr, test.db)
+		}
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	c, err := Parse(`sink {type: "influxdb"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := c.Service()
+	if svc.AddrNats != "localhost:4222" {
+		t.Errorf("got NATS %s, want localhost:4222", svc.AddrNats)
+	}
+	if !reflect.DeepEqual(svc.Subjects, []string{"metrics"}) {
+		t.Errorf("got subjects %v, want metrics", svc.Subjects)
+	}
+	if svc.InstrumentInterval != 10*time.Second {
+		t.Errorf("got instrument interval %s, want 10s", svc.InstrumentInterval)
+	}
+}
+
+func TestParse(t *testing.T) {
+	c, err := Parse(`
+nats {addr: "nats:4222", subjects: ["metrics", "app.>"]}
+queue {size: 100, overflow: "drop-oldest"}
+processors: [
+  {type: "filter", options {exclude: "debug_*"}}
+]
+sink {
+  type: "fanout"
+  fanout {
+    buffer_size: 10
+    sinks: [
+      {name: "a", type: "influxdb", influxdb {addr: "a:8086", flush_interval: "2s", max_retries: 3}}
+      {name: "archive", type: "file", file {path: "archive.lp", precision: "s"}}
+    ]
+  }
+}
+shutdown_timeout: "1m"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := c.Service()
+	if svc.AddrNats != "nats:4222" || !reflect.DeepEqual(svc.Subjects, []string{"metrics", "app.>"}) {
+		t.Errorf("got NATS %s, subjects %v", svc.AddrNats, svc.Subjects)
+	}
+	if svc.Queue.Size != 100 || svc.Queue.OverflowPolicy != "drop-oldest" {
+		t.Errorf("got queue %+v", svc.Queue)
+	}
+	if len(svc.Processors) != 1 || svc.Processors[0].Options["exclude"] != "debug_*" {
+		t.Errorf("got processors %+v", svc.Processors)
+	}
+	if svc.ShutdownTimeout != time.Minute {
+		t.Errorf("got shutdown timeout %s, want 1m", svc.ShutdownTimeout)
+	}
+	fanout := svc.Sink.Fanout
+	if fanout == nil || fanout.BufferSize != 10 || len(fanout.Sinks) != 2 {
+		t.Fatalf("got fan-out %+v", fanout)
+	}
+	influxDB := fanout.Sinks[0].InfluxDB
+	if influxDB.AddrInfluxDb != "a:8086" || influxDB.FlushInterval != 2*time.Second || influxDB.MaxRetries != 3 || influxDB.DbName != INFLUXDB_DB {
+		t.Errorf("got InfluxDB %+v", influxDB)
+	}
+	if file := fanout.Sinks[1].File; file.Path != "archive.lp" || file.Precision != "s" {
+		t.Errorf("got file %+v", file)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{`sink {type: "influxdb", influxdb {adr: "localhost"}}`, "sink.influxdb.adr: unknown setting"},
+		{`sink {type: "influxdb", influxdb {flush_interval: 5}}`, "sink.influxdb.flush_interval: expected a duration"},
+		{`sink {type: "influxdb", influxdb {flush_interval: "5"}}`, "sink.influxdb.flush_interval: invalid duration"},
+		{`sink {type: "influxdb", influxdb {flush_max_points: "many"}}`, "sink.influxdb.flush_max_points: expected an integer"},
+		{`nats {subjects: "metrics"}`, "nats.subjects: expected a list"},
+		{`processors: [{type: "filter", options: ["a"]}]`, "processors[0].options: expected a map"},
+		{`queue {overflow: "drop"}`, "invalid overflow policy"},
+		{`nats {addr: "localhost:4222"}`, "missing sink"},
+		{`sink {type: "influxdb", influxdb {precision: "d"}}`, "invalid precision"},
+		{`{"sink": }`, "invalid character"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.data)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.data, err, test.err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	type settings struct {
+		Name    string            `json:"name"`
+		Count   int               `json:"count"`
+		Ratio   float64           `json:"ratio"`
+		Enabled bool              `json:"enabled"`
+		Period  Duration          `json:"period"`
+		Tags    map[string]string `json:"tags"`
+		List    []string          `json:"list"`
+	}
+	tests := []struct {
+		in   map[string]interface{}
+		want map[string]interface{}
+		err  string
+	}{
+		{
+			in:   map[string]interface{}{"name": int64(1), "count": float64(2), "ratio": int64(1), "enabled": true, "period": "1s"},
+			want: map[string]interface{}{"name": "1", "count": float64(2), "ratio": int64(1), "enabled": true, "period": "1s"},
+		},
+		{
+			in:   map[string]interface{}{"tags": map[string]interface{}{"a": true}, "list": []interface{}{"x", 1.5}},
+			want: map[string]interface{}{"tags": map[string]interface{}{"a": "true"}, "list": []interface{}{"x", "1.5"}},
+		},
+		{in: map[string]interface{}{"count": 1.5}, err: "count: expected an integer, got 1.5"},
+		{in: map[string]interface{}{"ratio": "half"}, err: `ratio: expected a number, got "half"`},
+		{in: map[string]interface{}{"tags": map[string]interface{}{"a": []interface{}{}}}, err: "tags.a: expected a string, got a list"},
+		{in: map[string]interface{}{"list": []interface{}{"x", map[string]interface{}{}}}, err: "list[1]: expected a string, got a map"},
+		{in: map[string]interface{}{"other": "x"}, err: "other: unknown setting"},
+	}
+	for _, test := range tests {
+		got, err := normalize(test.in, reflect.TypeOf(settings{}), "")
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%v: got error %v, want %q", test.in, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("got %v, want %v", got, test.want)
+		}
+	}
+}
+
+func TestSinkValidation(t *testing.T) {
+	config := &timeseries.SinkConfiguration{
+		Type:     timeseries.SINK_INFLUXDB,
+		InfluxDB: &timeseries.InfluxDBConfiguration{AddrInfluxDb: INFLUXDB_ADDR},
+	}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "missing database name") {
+		t.Errorf("got error %v, want missing database name", err)
+	}
+}
+
+func TestParseQuarantineServers(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		servers  []string
+		user     string
+		password string
+	}{
+		{
+			"nats servers",
+			`nats {servers: ["nats://a:4222", "nats://b:4222"], user: "u", password: "p"}
+sink {type: "influxdb", influxdb {quarantine {subject: "rejected"}}}`,
+			[]string{"nats://a:4222", "nats://b:4222"}, "u", "p",
+		},
+		{
+			"nats address",
+			`nats {addr: "a:4222"}
+sink {type: "influxdb", influxdb {quarantine {subject: "rejected"}}}`,
+			[]string{"a:4222"}, "", "",
+		},
+		{
+			"embedded server",
+			`nats {addr: "a:4222", user: "other"}
+embedded_nats {addr: ":14444", user: "u", password: "p"}
+sink {type: "influxdb", influxdb {quarantine {subject: "rejected"}}}`,
+			[]string{"127.0.0.1:14444"}, "u", "p",
+		},
+		{
+			"own servers",
+			`embedded_nats {addr: ":14444"}
+sink {type: "influxdb", influxdb {quarantine {subject: "rejected", servers: ["c:4222"]}}}`,
+			[]string{"c:4222"}, "", "",
+		},
+	}
+	for _, test := range tests {
+		c, err := Parse(test.data)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		q := c.Service().Sink.InfluxDB.Quarantine
+		if !reflect.DeepEqual(q.Servers, test.servers) || q.User != test.user || q.Password != test.password {
+			t.Errorf("%s: got quarantine servers %v as %q:%q, want %v as %q:%q", test.name, q.Servers, q.User, q.Password, test.servers, test.user, test.password)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// Checks a parsed value against the type it is decoded into, reporting unknown
+// settings and values of the wrong type by their path, e.g. sink.influxdb.db.
+// Numbers and booleans are accepted where strings are expected, and converted.
+func normalize(v interface{}, t reflect.Type, path string) (interface{}, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == durationType {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a duration, e.g. \"10s\", got %s", path, describe(v))
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("%s: invalid duration %q, e.g. \"10s\"", path, s)
+		}
+		return s, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a map, got %s", path, describe(v))
+		}
+		for k, fv := range m {
+			f, ok := fieldByTag(t, k)
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown setting", join(path, k))
+			}
+			var err error
+			if m[k], err = normalize(fv, f.Type, join(path, k)); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a map, got %s", path, describe(v))
+		}
+		for k, ev := range m {
+			var err error
+			if m[k], err = normalize(ev, t.Elem(), join(path, k)); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case reflect.Slice:
+		a, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a list, got %s", path, describe(v))
+		}
+		for i, ev := range a {
+			var err error
+			if a[i], err = normalize(ev, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case reflect.String:
+		switch v.(type) {
+		case string:
+			return v, nil
+		case int64, float64, bool:
+			return fmt.Sprint(v), nil
+		}
+		return nil, fmt.Errorf("%s: expected a string, got %s", path, describe(v))
+	case reflect.Bool:
+		if _, ok := v.(bool); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("%s: expected true or false, got %s", path, describe(v))
+	case reflect.Int:
+		switch n := v.(type) {
+		case int64:
+			return v, nil
+		case float64:
+			// JSON numbers
+			if n == float64(int64(n)) {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: expected an integer, got %s", path, describe(v))
+	case reflect.Float64:
+		switch v.(type) {
+		case int64, float64:
+			return v, nil
+		}
+		return nil, fmt.Errorf("%s: expected a number, got %s", path, describe(v))
+	}
+	return nil, fmt.Errorf("%s: unsupported setting", path)
+}
+
+// Returns the struct field decoded from the given JSON key
+func fieldByTag(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if strings.Split(f.Tag.Get("json"), ",")[0] == key {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func describe(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case map[string]interface{}:
+		return "a map"
+	case []interface{}:
+		return "a list"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,200 @@
+package input
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	INPUT_HTTP = "http"
+)
+
+func init() {
+	RegisterInput(INPUT_HTTP, NewHTTPInput)
+}
+
+// Receives points POSTed as JSON to /write, either a single point or a list:
+//
+//	{"measurement": "cpu", "tags": {"host": "a"}, "fields": {"value": 0.64}, "time": "2016-01-02T15:04:05Z"}
+//
+// Points without time are timestamped by InfluxDB. Options:
+//
+//	addr   address to listen on, host:port
+//	users  optional comma-separated user:password pairs requests must
+//	       authenticate with, using basic authentication
+//
+// Points are attributed to the user they were sent by, see Point.Producer.
+type httpInput struct {
+	addr     string
+	users    map[string]string
+	listener net.Listener
+	emit     func(point *timeseries.Point)
+	// held while handling a request, so that Stop waits for them
+	mu      sync.RWMutex
+	stopped bool
+	// instrumentation
+	received *instrument.Counter
+	invalid  *instrument.Counter
+}
+
+type jsonPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+func NewHTTPInput(config *Configuration) (Input, error) {
+	if err := checkOptions(config.Options, "addr", "users"); err != nil {
+		return nil, err
+	}
+	if config.Options["addr"] == "" {
+		return nil, errors.New("missing addr option")
+	}
+	users := make(map[string]string)
+	for _, pair := range strings.Split(config.Options["users"], ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		up := strings.SplitN(pair, ":", 2)
+		if len(up) != 2 || up[0] == "" {
+			return nil, fmt.Errorf("invalid user:password pair %q", pair)
+		}
+		users[up[0]] = up[1]
+	}
+	tags := map[string]string{"input": config.Name}
+	return &httpInput{
+		addr:     config.Options["addr"],
+		users:    users,
+		received: instrument.Default.Counter("metricas_input", tags, "points_received"),
+		invalid:  instrument.Default.Counter("metricas_input", tags, "parse_errors"),
+	}, nil
+}
+
+func (in *httpInput) Start(emit func(point *timeseries.Point)) error {
+	l, err := net.Listen("tcp", in.addr)
+	if err != nil {
+		return err
+	}
+	in.listener = l
+	in.emit = emit
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", in.handleWrite)
+	go http.Serve(l, mux)
+	return nil
+}
+
+func (in *httpInput) Stop() error {
+	err := in.listener.Close()
+	in.mu.Lock()
+	in.stopped = true
+	in.mu.Unlock()
+	return err
+}
+
+func (in *httpInput) handleWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if len(in.users) > 0 {
+		if expected, known := in.users[user]; !ok || !known || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metricas"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	points, err := decodePoints(r)
+	if err != nil {
+		in.invalid.Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	if in.stopped {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	for _, point := range points {
+		point.Producer = user
+		in.emit(point)
+	}
+	in.received.Add(uint64(len(points)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Decodes a point or a list of points
+func decodePoints(r *http.Request) ([]*timeseries.Point, error) {
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	var jsonPoints []*jsonPoint
+	if len(raw) > 0 && raw[0] == '[' {
+		if err := unmarshalUseNumber(raw, &jsonPoints); err != nil {
+			return nil, err
+		}
+	} else {
+		jp := &jsonPoint{}
+		if err := unmarshalUseNumber(raw, jp); err != nil {
+			return nil, err
+		}
+		jsonPoints = append(jsonPoints, jp)
+	}
+
+	points := make([]*timeseries.Point, 0, len(jsonPoints))
+	for i, jp := range jsonPoints {
+		if jp.Measurement == "" {
+			return nil, fmt.Errorf("point %d: missing measurement", i)
+		}
+		if len(jp.Fields) == 0 {
+			return nil, fmt.Errorf("point %d: missing fields", i)
+		}
+		for k, v := range jp.Fields {
+			switch v := v.(type) {
+			case json.Number:
+				// integers are kept as such, as InfluxDB tells them apart
+				if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+					jp.Fields[k] = n
+				} else if f, err := v.Float64(); err == nil {
+					jp.Fields[k] = f
+				} else {
+					return nil, fmt.Errorf("point %d: invalid field %s", i, k)
+				}
+			case string, bool:
+			default:
+				return nil, fmt.Errorf("point %d: invalid field %s, must be a number, string or boolean", i, k)
+			}
+		}
+		points = append(points, &timeseries.Point{
+			Measurement: jp.Measurement,
+			Tags:        jp.Tags,
+			Fields:      jp.Fields,
+			Time:        jp.Time,
+		})
+	}
+	return points, nil
+}
+
+func unmarshalUseNumber(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
@@ -0,0 +1,71 @@
+package input
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+// An Input receives points from outside of NATS, e.g. over HTTP or StatsD
+type Input interface {
+	// Start starts receiving points, handing them to emit
+	Start(emit func(point *timeseries.Point)) error
+	// Stop stops receiving points, returning once every point received was
+	// handed to emit
+	Stop() error
+}
+
+type Configuration struct {
+	Name    string            // identifies the input, defaults to its type
+	Type    string            // as registered with RegisterInput
+	Options map[string]string // settings, depending on the type
+}
+
+// Creates an input from its configuration, without receiving anything until
+// started
+type InputFactory func(config *Configuration) (Input, error)
+
+var (
+	inputsMu sync.Mutex
+	inputs   = make(map[string]InputFactory)
+)
+
+// Makes an input type available to NewInput. It is meant to be called from the
+// init function of the package implementing the input.
+func RegisterInput(inputType string, factory InputFactory) {
+	inputsMu.Lock()
+	defer inputsMu.Unlock()
+	if _, dup := inputs[inputType]; dup {
+		panic("input: input " + inputType + " registered twice")
+	}
+	inputs[inputType] = factory
+}
+
+// Creates an input of the configured type
+func NewInput(config *Configuration) (Input, error) {
+	inputsMu.Lock()
+	factory, ok := inputs[config.Type]
+	inputsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown input type %q", config.Type)
+	}
+	return factory(config)
+}
+
+// Returns an error naming the first option not in known
+func checkOptions(options map[string]string, known ...string) error {
+	for k := range options {
+		found := false
+		for _, option := range known {
+			if k == option {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown option %q", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package input
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	INPUT_STATSD = "statsd"
+
+	STATSD_ADDR        = ":8125" // default StatsD port
+	STATSD_PACKET_SIZE = 65536   // largest UDP packet read
+)
+
+func init() {
+	RegisterInput(INPUT_STATSD, NewStatsDInput)
+}
+
+// Receives StatsD samples over UDP, one per line, e.g.
+//
+//	requests:1|c|@0.1|#path:/login,status:200
+//
+// Every sample becomes a point, there is no aggregation: the measurement is the
+// sample name, the value field holds the value, divided by the sample rate for
+// counters, and the type tag holds the sample type (c, g, ms, h or s). Options:
+//
+//	addr  address to listen on, host:port, defaults to STATSD_ADDR
+type statsdInput struct {
+	addr string
+	conn net.PacketConn
+	done chan struct{}
+	// instrumentation
+	received *instrument.Counter
+	invalid  *instrument.Counter
+}
+
+func NewStatsDInput(config *Configuration) (Input, error) {
+	if err := checkOptions(config.Options, "addr"); err != nil {
+		return nil, err
+	}
+	addr := config.Options["addr"]
+	if addr == "" {
+		addr = STATSD_ADDR
+	}
+	tags := map[string]string{"input": config.Name}
+	return &statsdInput{
+		addr:     addr,
+		done:     make(chan struct{}),
+		received: instrument.Default.Counter("metricas_input", tags, "points_received"),
+		invalid:  instrument.Default.Counter("metricas_input", tags, "parse_errors"),
+	}, nil
+}
+
+func (in *statsdInput) Start(emit func(point *timeseries.Point)) error {
+	conn, err := net.ListenPacket("udp", in.addr)
+	if err != nil {
+		return err
+	}
+	in.conn = conn
+	go in.run(emit)
+	return nil
+}
+
+func (in *statsdInput) Stop() error {
+	err := in.conn.Close()
+	<-in.done
+	return err
+}
+
+// Reads packets until the connection is closed
+func (in *statsdInput) run(emit func(point *timeseries.Point)) {
+	defer close(in.done)
+	buf := make([]byte, STATSD_PACKET_SIZE)
+	for {
+		n, _, err := in.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			point, err := parseStatsD(string(line))
+			if err != nil {
+				in.invalid.Inc()
+				continue
+			}
+			in.received.Inc()
+			emit(point)
+		}
+	}
+}
+
+// Parses name:value|type[|@rate][|#tag:value,...]
+func parseStatsD(line string) (*timeseries.Point, error) {
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return nil, errors.New("missing name")
+	}
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return nil, errors.New("missing type")
+	}
+	point := &timeseries.Point{
+		Measurement: line[:colon],
+		Tags:        map[string]string{"type": parts[1]},
+		Fields:      make(map[string]interface{}, 1),
+	}
+	rate := 1.0
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			r, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return nil, fmt.Errorf("invalid sample rate %q", part)
+			}
+			rate = r
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 2 && kv[0] != "" {
+					point.Tags[kv[0]] = kv[1]
+				}
+			}
+		}
+	}
+	switch parts[1] {
+	case "c", "g", "ms", "h":
+		v, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid value %q", parts[0])
+		}
+		if parts[1] == "c" {
+			v /= rate
+		}
+		point.Fields["value"] = v
+	case "s":
+		point.Fields["value"] = parts[0]
+	default:
+		return nil, fmt.Errorf("unknown type %q", parts[1])
+	}
+	return point, nil
+}
@@ -0,0 +1,57 @@
+package input
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStatsD(t *testing.T) {
+	tests := []struct {
+		line   string
+		tags   map[string]string
+		fields map[string]interface{}
+	}{
+		{"hits:1|c", map[string]string{"type": "c"}, map[string]interface{}{"value": 1.0}},
+		{"hits:1|c|@0.1", map[string]string{"type": "c"}, map[string]interface{}{"value": 10.0}},
+		{"load:0.5|g|@0.1", map[string]string{"type": "g"}, map[string]interface{}{"value": 0.5}},
+		{"latency:320|ms|#host:a,region:eu", map[string]string{"type": "ms", "host": "a", "region": "eu"}, map[string]interface{}{"value": 320.0}},
+		{"size:12|h|#bad,:x", map[string]string{"type": "h"}, map[string]interface{}{"value": 12.0}},
+		{"users:alice|s", map[string]string{"type": "s"}, map[string]interface{}{"value": "alice"}},
+	}
+	for _, test := range tests {
+		point, err := parseStatsD(test.line)
+		if err != nil {
+			t.Errorf("%s: %s", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(point.Tags, test.tags) {
+			t.Errorf("%s: tags %v, expected %v", test.line, point.Tags, test.tags)
+		}
+		if !reflect.DeepEqual(point.Fields, test.fields) {
+			t.Errorf("%s: fields %v, expected %v", test.line, point.Fields, test.fields)
+		}
+	}
+}
+
+func TestParseStatsDErrors(t *testing.T) {
+	for _, line := range []string{
+		"",
+		":1|c",
+		"hits",
+		"hits:1",
+		"hits:x|c",
+		"hits:NaN|g",
+		"hits:nan|g",
+		"hits:Inf|ms",
+		"hits:+Inf|c",
+		"hits:-Inf|h",
+		"hits:1e400|g",
+		"hits:1|c|@0",
+		"hits:1|c|@2",
+		"hits:1|x",
+	} {
+		if point, err := parseStatsD(line); err == nil {
+			t.Errorf("%q: expected an error, got %v", line, point)
+		}
+	}
+}
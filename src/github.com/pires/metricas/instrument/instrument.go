@@ -0,0 +1,251 @@
+package instrument
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HISTOGRAM_SAMPLES = 1024 // percentiles are computed over the latest 1024 samples
+)
+
+// Registry used by metricas packages to instrument themselves
+var Default = NewRegistry()
+
+// Counts events
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Tracks the distribution of observed values, e.g. latencies or sizes
+type Histogram struct {
+	mu      sync.Mutex
+	count   uint64
+	sum     float64
+	min     float64
+	max     float64
+	samples []float64 // ring of the latest samples
+	next    int
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if h.count == 0 || v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += v
+	if len(h.samples) < HISTOGRAM_SAMPLES {
+		h.samples = append(h.samples, v)
+		return
+	}
+	h.samples[h.next] = v
+	h.next = (h.next + 1) % HISTOGRAM_SAMPLES
+}
+
+// Observes the time elapsed since start, in milliseconds
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(float64(time.Since(start)) / float64(time.Millisecond))
+}
+
+// Summary of the observed values, keyed by statistic
+func (h *Histogram) fields(name string, fields map[string]interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fields[name+"_count"] = int64(h.count)
+	if h.count == 0 {
+		return
+	}
+	fields[name+"_sum"] = h.sum
+	fields[name+"_min"] = h.min
+	fields[name+"_max"] = h.max
+	fields[name+"_mean"] = h.sum / float64(h.count)
+	sorted := make([]float64, len(h.samples))
+	copy(sorted, h.samples)
+	sort.Float64s(sorted)
+	fields[name+"_p50"] = percentile(sorted, 0.50)
+	fields[name+"_p90"] = percentile(sorted, 0.90)
+	fields[name+"_p99"] = percentile(sorted, 0.99)
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// A measurement taken from a registry
+type Measurement struct {
+	Name   string                 `json:"name"`
+	Tags   map[string]string      `json:"tags,omitempty"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// Named counters, gauges and histograms, grouped into measurements of the same
+// name and tags, e.g. the counters received and invalid of measurement nats
+// with tag subject=metrics
+type Registry struct {
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	name       string
+	tags       map[string]string
+	owner      interface{} // see Claim
+	counters   map[string]*Counter
+	gauges     map[string]func() int64
+	histograms map[string]*Histogram
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		series: make(map[string]*series),
+	}
+}
+
+// Returns the counter of the given field, creating it if needed
+func (r *Registry) Counter(name string, tags map[string]string, field string) *Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.get(name, tags)
+	c, ok := s.counters[field]
+	if !ok {
+		c = &Counter{}
+		s.counters[field] = c
+	}
+	return c
+}
+
+// Registers a function reporting the current value of the given field,
+// replacing any previous one
+func (r *Registry) Gauge(name string, tags map[string]string, field string, f func() int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.get(name, tags).gauges[field] = f
+}
+
+// Returns the histogram of the given field, creating it if needed
+func (r *Registry) Histogram(name string, tags map[string]string, field string) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.get(name, tags)
+	h, ok := s.histograms[field]
+	if !ok {
+		h = &Histogram{}
+		s.histograms[field] = h
+	}
+	return h
+}
+
+// Forgets all fields of the given measurement and tags, e.g. when the
+// instrumented component goes away
+func (r *Registry) Unregister(name string, tags map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.series, seriesKey(name, tags))
+}
+
+// Marks the measurement of the given tags as instrumenting owner, e.g. a
+// component that goes away and is replaced by another instrumented the same
+// way, which claims it in turn
+func (r *Registry) Claim(name string, tags map[string]string, owner interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.get(name, tags).owner = owner
+}
+
+// Forgets all fields of the given measurement and tags, unless claimed by
+// another owner since owner did
+func (r *Registry) Release(name string, tags map[string]string, owner interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := seriesKey(name, tags)
+	if s, ok := r.series[key]; ok && s.owner == owner {
+		delete(r.series, key)
+	}
+}
+
+// Current values of all fields, by measurement
+func (r *Registry) Snapshot() []Measurement {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, len(r.series))
+	for k := range r.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	measurements := make([]Measurement, 0, len(keys))
+	for _, k := range keys {
+		s := r.series[k]
+		m := Measurement{
+			Name:   s.name,
+			Tags:   s.tags,
+			Fields: make(map[string]interface{}),
+		}
+		for field, c := range s.counters {
+			m.Fields[field] = int64(c.Value())
+		}
+		for field, g := range s.gauges {
+			m.Fields[field] = g()
+		}
+		for field, h := range s.histograms {
+			h.fields(field, m.Fields)
+		}
+		measurements = append(measurements, m)
+	}
+	return measurements
+}
+
+// Serves a snapshot as JSON
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(r.Snapshot())
+}
+
+// Lock must be held
+func (r *Registry) get(name string, tags map[string]string) *series {
+	key := seriesKey(name, tags)
+	s, ok := r.series[key]
+	if !ok {
+		s = &series{
+			name:       name,
+			tags:       tags,
+			counters:   make(map[string]*Counter),
+			gauges:     make(map[string]func() int64),
+			histograms: make(map[string]*Histogram),
+		}
+		r.series[key] = s
+	}
+	return s
+}
+
+func seriesKey(name string, tags map[string]string) string {
+	parts := make([]string, 0, len(tags)+1)
+	for k, v := range tags {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return name + "," + strings.Join(parts, ",")
+}
@@ -1,59 +1,429 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
-	"runtime/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/nats-io/nats"
+
+	"github.com/pires/metricas/admin"
+	"github.com/pires/metricas/config"
+	"github.com/pires/metricas/natsserver"
 	"github.com/pires/metricas/service"
 	"github.com/pires/metricas/timeseries"
 )
 
 var (
-	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
-	db         = flag.String("db", "localhost:8086", "InfluxDB address (host:port)")
+	configFile = flag.String("config", "", "Optional configuration file, used instead of the other flags but -block_profile_rate")
+	checkConf  = flag.Bool("check-config", false, "Validate the configuration and exit")
+	db         = flag.String("db", config.INFLUXDB_ADDR, "InfluxDB address (host:port), comma-separated for the fanout and shard sinks")
 	dbUser     = flag.String("db_user", "", "Optional user to access InfluxDB")
 	dbPwd      = flag.String("db_pwd", "", "Optional user password to access InfluxDB")
-	dbName     = flag.String("db_name", "metrics", "InfluxDB database to write to")
-	nats       = flag.String("nats", "localhost:4222", "NATS adress (host:port)")
+	dbName     = flag.String("db_name", config.INFLUXDB_DB, "InfluxDB database to write to")
+	dbRp       = flag.String("db_rp", timeseries.DEFAULT_RETENTION_POLICY, "InfluxDB retention policy to write to")
+	dbRps      = flag.String("db_rp_overrides", "", "Optional per-measurement retention policies (measurement=rp,...)")
+	dbPrec     = flag.String("db_precision", "", "Optional write precision (n, u, ms, s, m or h)")
+	dbCons     = flag.String("db_consistency", "", "Optional write consistency (any, one, quorum or all)")
+	dbProto    = flag.String("db_write_protocol", timeseries.WRITE_PROTOCOL_LINE, "How points are written to InfluxDB (line or batch)")
+	dbRetries  = flag.Int("db_max_retries", 0, "Times a failed write to InfluxDB is retried before its points are discarded")
+	dbBackoff  = flag.Duration("db_retry_backoff", timeseries.RETRY_BACKOFF_MS*time.Millisecond, "Time to wait before retrying a failed write, doubled on each retry")
+	dbHTTPS    = flag.Bool("db_https", false, "Connect to InfluxDB over HTTPS")
+	dbCACert   = flag.String("db_ca_cert", "", "Optional PEM file of the CA InfluxDB certificates are verified against, instead of the system ones")
+	dbSkipVer  = flag.Bool("db_insecure_skip_verify", false, "Do not verify InfluxDB certificates")
+	dbTimeout  = flag.Duration("db_timeout", timeseries.REQUEST_TIMEOUT_MS*time.Millisecond, "Time allowed for requests to InfluxDB")
+	dbAgent    = flag.String("db_user_agent", timeseries.USER_AGENT, "User agent of requests to InfluxDB")
+	dbNoKeep   = flag.Bool("db_disable_keep_alives", false, "Open a new connection for every request to InfluxDB")
+	dbIdle     = flag.Int("db_max_idle_conns", timeseries.MAX_IDLE_CONNS, "Idle connections kept open to each InfluxDB")
+	dbIdleTo   = flag.Duration("db_idle_conn_timeout", timeseries.IDLE_CONN_TIMEOUT_MS*time.Millisecond, "Time idle connections to InfluxDB are kept open")
+	dbWait     = flag.Duration("db_startup_wait", 0, "Time to wait for InfluxDB to answer at startup, failing right away when 0 and waiting forever when negative")
+	dbTenant   = flag.String("db_tenant_tag", "", "Optional tag naming the InfluxDB database points are written to instead of -db_name, removed from them")
+	dbProvis   = flag.Bool("db_provision", false, "Create the InfluxDB databases and -db_provision_rps when missing, and alter policies that differ")
+	dbProvRps  = flag.String("db_provision_rps", "", "Retention policies to provision (name=duration[:replication],...), INF keeping data forever, -db_rp being the default")
+	dbDownsmp  = flag.String("db_downsample", "", "Downsampling tiers to provision as continuous queries (interval=rp[:function],...), each rolling up -db_rp into its own retention policy")
+	dbDryRun   = flag.Bool("db_provision_dry_run", false, "Log the statements provisioning would execute instead of executing them")
+	dbConflict = flag.String("db_field_conflicts", "", "Check points against the field types InfluxDB stores before writing them, coercing conflicting points or quarantining them (coerce or quarantine)")
+	dbQuarant  = flag.String("db_quarantine", "", "Optional file points InfluxDB rejects, or would reject, are appended to, in line protocol, instead of being discarded")
+	dbQuarSubj = flag.String("db_quarantine_subject", "", "Optional NATS subject points InfluxDB rejects, or would reject, are published to, in line protocol, through the -nats servers, or the embedded one")
+	dbBreaker  = flag.Int("db_breaker_threshold", 0, "Consecutive failed writes after which InfluxDB is left alone, holding points, until it answers again (0 disables)")
+	dbBreakCd  = flag.Duration("db_breaker_cooldown", timeseries.BREAKER_COOLDOWN_MS*time.Millisecond, "Time InfluxDB is left alone before pinging it again")
+	dbAdaptive = flag.Duration("db_adaptive_latency", 0, "Write latency to stay under by shrinking batches and flushing less often (0 disables)")
+	archive    = flag.String("archive", "", "Optional file the fanout sink archives points to, in line protocol")
+	fanoutBuf  = flag.Int("fanout_buffer", timeseries.FANOUT_BUFFER_SIZE, "Points queued per fanout sink backend before dropping")
+	shardVn    = flag.Int("shard_vnodes", timeseries.HASH_RING_VIRTUAL_NODES, "Virtual nodes per InfluxDB on the shard sink hash ring")
+	shardRf    = flag.Int("shard_replicas", 1, "InfluxDB instances every series is written to by the shard sink")
+	flushIntvl = flag.Duration("flush_interval", timeseries.FLUSH_INTERVAL_MS*time.Millisecond, "Maximum time points are buffered before written")
+	flushMax   = flag.Int("flush_max_points", timeseries.FLUSH_MAX_POINTS, "Maximum number of points buffered before written")
+	natsAddrs  = flag.String("nats", "localhost:4222", "Comma-separated NATS cluster server addresses (host:port or nats:// URLs)")
+	natsUser   = flag.String("nats_user", "", "Optional NATS user")
+	natsPwd    = flag.String("nats_pwd", "", "Optional NATS password")
+	natsToken  = flag.String("nats_token", "", "Optional NATS authentication token, instead of a user and password")
+	natsSecure = flag.Bool("nats_secure", false, "Connect to NATS over TLS")
+	natsCACert = flag.String("nats_ca_cert", "", "Optional PEM file of the CA NATS certificates are verified against, instead of the system ones")
+	natsCert   = flag.String("nats_cert", "", "Optional PEM file of the client certificate presented to NATS, along with -nats_key")
+	natsKey    = flag.String("nats_key", "", "Optional PEM file of the key of the client certificate presented to NATS")
+	natsSkipV  = flag.Bool("nats_insecure_skip_verify", false, "Do not verify NATS certificates")
+	natsWait   = flag.Duration("nats_reconnect_wait", nats.DefaultReconnectWait, "Time to wait before reconnecting to a NATS server")
+	natsMaxRc  = flag.Int("nats_max_reconnect", nats.DefaultMaxReconnect, "Attempts to reconnect to every NATS server before giving up, never when negative")
+	natsPing   = flag.Duration("nats_ping_interval", nats.DefaultPingInterval, "How often NATS servers are pinged to detect broken connections")
+	embedded   = flag.Bool("embedded_nats", false, "Run a NATS server in-process and consume metrics from it, instead of -nats")
+	embAddr    = flag.String("embedded_nats_addr", natsserver.ADDR, "Address (host:port) the embedded NATS server listens on, all interfaces without host")
+	embUser    = flag.String("embedded_nats_user", "", "Optional user clients of the embedded NATS server authenticate with")
+	embPwd     = flag.String("embedded_nats_pwd", "", "Optional password clients of the embedded NATS server authenticate with")
+	embHTTP    = flag.Int("embedded_nats_http_port", 0, "Optional port of the embedded NATS server monitoring endpoints")
+	subjects   = flag.String("subjects", service.SUBJECT, "Comma-separated NATS subjects to consume metrics from")
+	queueSize  = flag.Int("queue_size", service.QUEUE_SIZE, "Points queued between NATS and the storage backend")
+	queueOvf   = flag.String("queue_overflow", service.OVERFLOW_BLOCK, "What to do with points once the queue is full (block, drop-newest, drop-oldest or sample)")
+	queueRate  = flag.Int("queue_sample_rate", service.QUEUE_SAMPLE_RATE, "Keep one in this many points when sampling")
+	instrIntvl = flag.Duration("instrument_interval", 10*time.Second, "How often internal measurements are written, never when 0")
+	httpAddr   = flag.String("http", "", "Optional address (host:port) of the admin HTTP server")
+	blockRate  = flag.Int("block_profile_rate", 0, "Nanoseconds blocked per sample of /debug/pprof/block, disabled when 0")
+	readyRatio = flag.Float64("ready_queue_ratio", service.READY_QUEUE_RATIO, "Queue fill ratio above which the service is not ready")
+	shutdownTo = flag.Duration("shutdown_timeout", service.SHUTDOWN_TIMEOUT_MS*time.Millisecond, "Time allowed to write buffered points on shutdown")
+	sinkType   = flag.String("sink", timeseries.SINK_INFLUXDB, "Type of storage backend to write to (influxdb, fanout or shard)")
 )
 
 func main() {
 	flag.Parse()
+	os.Exit(run())
+}
 
-	if *cpuprofile != "" {
-		f, err := os.Create(*cpuprofile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
+// Runs the service until signaled to stop, returning the exit status
+func run() int {
+	svcConfig, httpAddr, err := configuration()
+	if err != nil {
+		log.Fatalln(err)
 	}
-
-	config := &service.Configuration{
-		AddrNats: *nats,
-		TimeSeriesConfig: &timeseries.Configuration{
-			AddrInfluxDb: *db,
-			DbUser:       *dbUser,
-			DbPwd:        *dbPwd,
-			DbName:       *dbName,
-		},
+	if *checkConf {
+		log.Println("Configuration is valid.")
+		return 0
 	}
 
 	log.Println("Starting metrics service...")
-	svc, err := service.NewMetricsService(config)
+	svc, err := service.NewMetricsService(svcConfig)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer close(svc)
+	if httpAddr != "" {
+		runtime.SetBlockProfileRate(*blockRate)
+		go func() {
+			log.Fatalln(http.ListenAndServe(httpAddr, admin.NewHandler(svc)))
+		}()
+	}
+	if err := svc.Start(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+	go func() {
+		for err := range svc.Errors() {
+			log.Println(err)
+		}
+	}()
+	go reloadOnHangup(svc)
 
 	log.Printf("Press ^C to quit.")
-	// wait for Ctrl-c to stop server
+	// wait for Ctrl-c or SIGTERM to stop server
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	<-c
+	log.Printf("Shutting down, writing buffered points for up to %s (^C again to quit now)...", svcConfig.ShutdownTimeout)
+	svc.Stop()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- svc.Wait()
+	}()
+	select {
+	case err = <-stopped:
+	case <-c:
+		err = errors.New("interrupted while shutting down")
+	}
+	if err != nil {
+		log.Printf("Terminated metrics server, data was lost: %s", err)
+		return 1
+	}
 	log.Println("Terminated metrics server.")
+	return 0
+}
+
+// Reloads the configuration file on SIGHUP
+func reloadOnHangup(svc *service.MetricsService) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if *configFile == "" {
+			log.Println("Ignoring SIGHUP, there is no configuration file to reload")
+			continue
+		}
+		c, err := config.Load(*configFile)
+		if err == nil {
+			err = svc.Reload(c.Service())
+		}
+		if err != nil {
+			log.Printf("Failed reloading the configuration, keeping the current one: %s", err)
+			continue
+		}
+		log.Printf("Reloaded %s.", *configFile)
+	}
+}
+
+// Loads the configuration file, or builds the configuration out of flags,
+// returning it along with the address of the admin HTTP server
+func configuration() (*service.Configuration, string, error) {
+	if *configFile != "" {
+		c, err := config.Load(*configFile)
+		if err != nil {
+			return nil, "", err
+		}
+		return c.Service(), c.HTTP, nil
+	}
+
+	rps, err := parseKeyValues(*dbRps)
+	if err != nil {
+		return nil, "", err
+	}
+	if !*dbProvis && (*dbProvRps != "" || *dbDownsmp != "" || *dbDryRun) {
+		return nil, "", errors.New("-db_provision_rps, -db_downsample and -db_provision_dry_run require -db_provision")
+	}
+	var provision *timeseries.ProvisionConfiguration
+	if *dbProvis {
+		if provision, err = parseProvision(*dbProvRps, *dbRp); err != nil {
+			return nil, "", err
+		}
+		if provision.Downsampling, err = parseDownsampling(*dbDownsmp); err != nil {
+			return nil, "", err
+		}
+		provision.DryRun = *dbDryRun
+	}
+	svcConfig := &service.Configuration{
+		NATS: &service.NATSConfiguration{
+			Servers:            strings.Split(*natsAddrs, ","),
+			User:               *natsUser,
+			Password:           *natsPwd,
+			Token:              *natsToken,
+			Secure:             *natsSecure,
+			CACert:             *natsCACert,
+			Cert:               *natsCert,
+			Key:                *natsKey,
+			InsecureSkipVerify: *natsSkipV,
+			ReconnectWait:      *natsWait,
+			MaxReconnect:       *natsMaxRc,
+			PingInterval:       *natsPing,
+		},
+		Subjects: strings.Split(*subjects, ","),
+		Queue: &service.QueueConfiguration{
+			Size:           *queueSize,
+			OverflowPolicy: *queueOvf,
+			SampleRate:     *queueRate,
+		},
+		Sink:               sinkConfiguration(rps, provision),
+		ShutdownTimeout:    *shutdownTo,
+		InstrumentInterval: *instrIntvl,
+		ReadyQueueRatio:    *readyRatio,
+	}
+	if *embedded {
+		svcConfig.EmbeddedNATS = &natsserver.Configuration{
+			Addr:     *embAddr,
+			User:     *embUser,
+			Password: *embPwd,
+			HTTPPort: *embHTTP,
+		}
+	}
+	return svcConfig, *httpAddr, svcConfig.Validate()
+}
+
+// Builds the sink configuration out of flags
+func sinkConfiguration(rps map[string]string, provision *timeseries.ProvisionConfiguration) *timeseries.SinkConfiguration {
+	var quarantine *timeseries.QuarantineConfiguration
+	if *dbQuarant != "" || *dbQuarSubj != "" {
+		quarantine = &timeseries.QuarantineConfiguration{
+			Path:               *dbQuarant,
+			Subject:            *dbQuarSubj,
+			Servers:            strings.Split(*natsAddrs, ","),
+			User:               *natsUser,
+			Password:           *natsPwd,
+			Token:              *natsToken,
+			Secure:             *natsSecure,
+			CACert:             *natsCACert,
+			Cert:               *natsCert,
+			Key:                *natsKey,
+			InsecureSkipVerify: *natsSkipV,
+		}
+		if *embedded {
+			// the embedded server, which authenticates with neither tokens
+			// nor TLS, once started
+			embeddedNATS := &natsserver.Configuration{Addr: *embAddr}
+			embeddedNATS.Validate() // validated along with the service
+			quarantine.Servers = []string{embeddedNATS.ClientAddr()}
+			quarantine.User, quarantine.Password, quarantine.Token = *embUser, *embPwd, ""
+			quarantine.Secure, quarantine.InsecureSkipVerify = false, false
+			quarantine.CACert, quarantine.Cert, quarantine.Key = "", "", ""
+		}
+	}
+	influxDbConfig := func(addr string) *timeseries.InfluxDBConfiguration {
+		return &timeseries.InfluxDBConfiguration{
+			AddrInfluxDb:       addr,
+			DbUser:             *dbUser,
+			DbPwd:              *dbPwd,
+			DbName:             *dbName,
+			DatabaseTag:        *dbTenant,
+			FlushInterval:      *flushIntvl,
+			FlushMaxPoints:     *flushMax,
+			RetentionPolicy:    *dbRp,
+			RetentionPolicies:  rps,
+			Precision:          *dbPrec,
+			WriteConsistency:   *dbCons,
+			WriteProtocol:      *dbProto,
+			MaxRetries:         *dbRetries,
+			RetryBackoff:       *dbBackoff,
+			HTTPS:              *dbHTTPS,
+			CACert:             *dbCACert,
+			InsecureSkipVerify: *dbSkipVer,
+			Timeout:            *dbTimeout,
+			UserAgent:          *dbAgent,
+			DisableKeepAlives:  *dbNoKeep,
+			MaxIdleConns:       *dbIdle,
+			IdleConnTimeout:    *dbIdleTo,
+			StartupWait:        *dbWait,
+			Provision:          provision,
+			FieldConflicts:     *dbConflict,
+			Quarantine:         quarantine,
+			BreakerThreshold:   *dbBreaker,
+			BreakerCooldown:    *dbBreakCd,
+			AdaptiveLatency:    *dbAdaptive,
+		}
+	}
+
+	switch *sinkType {
+	case timeseries.SINK_FANOUT:
+		// one backend per InfluxDB, plus the archive
+		fanout := &timeseries.FanoutConfiguration{
+			BufferSize: *fanoutBuf,
+		}
+		for _, addr := range strings.Split(*db, ",") {
+			fanout.Sinks = append(fanout.Sinks, &timeseries.SinkConfiguration{
+				Name:     addr,
+				Type:     timeseries.SINK_INFLUXDB,
+				InfluxDB: influxDbConfig(addr),
+			})
+		}
+		if *archive != "" {
+			fanout.Sinks = append(fanout.Sinks, &timeseries.SinkConfiguration{
+				Name: *archive,
+				Type: timeseries.SINK_FILE,
+				File: &timeseries.FileConfiguration{
+					Path:      *archive,
+					Precision: *dbPrec,
+				},
+			})
+		}
+		return &timeseries.SinkConfiguration{
+			Type:   timeseries.SINK_FANOUT,
+			Fanout: fanout,
+		}
+	case timeseries.SINK_SHARD:
+		// one shard per InfluxDB, named after its address
+		shard := &timeseries.ShardConfiguration{
+			VirtualNodes:      *shardVn,
+			ReplicationFactor: *shardRf,
+		}
+		for _, addr := range strings.Split(*db, ",") {
+			shard.Sinks = append(shard.Sinks, &timeseries.SinkConfiguration{
+				Name:     addr,
+				Type:     timeseries.SINK_INFLUXDB,
+				InfluxDB: influxDbConfig(addr),
+			})
+		}
+		return &timeseries.SinkConfiguration{
+			Type:  timeseries.SINK_SHARD,
+			Shard: shard,
+		}
+	default:
+		return &timeseries.SinkConfiguration{
+			Type:     *sinkType,
+			InfluxDB: influxDbConfig(*db),
+		}
+	}
+}
+
+// Parses retention policies to provision, e.g. raw=168h,downsampled=INF:2
+func parseProvision(s, defaultRp string) (*timeseries.ProvisionConfiguration, error) {
+	provision := &timeseries.ProvisionConfiguration{}
+	if s == "" {
+		return provision, nil
+	}
+	for _, def := range strings.Split(s, ",") {
+		kv := strings.SplitN(def, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid retention policy %q, expected name=duration[:replication]", def)
+		}
+		rp := &timeseries.RetentionPolicyConfiguration{Name: kv[0], Default: kv[0] == defaultRp}
+		v := strings.SplitN(kv[1], ":", 2)
+		var err error
+		if rp.Duration, err = timeseries.ParseRetentionDuration(v[0]); err != nil {
+			return nil, fmt.Errorf("invalid retention policy %q: %s", def, err)
+		}
+		if len(v) == 2 {
+			if rp.Replication, err = strconv.Atoi(v[1]); err != nil {
+				return nil, fmt.Errorf("invalid retention policy %q: %s", def, err)
+			}
+		}
+		provision.RetentionPolicies = append(provision.RetentionPolicies, rp)
+	}
+	for _, rp := range provision.RetentionPolicies {
+		if rp.Default {
+			return provision, nil
+		}
+	}
+	return nil, fmt.Errorf("retention policy %s written to is not among those provisioned", defaultRp)
+}
+
+// Parses downsampling tiers, e.g. 1m=rollup_1m,1h=rollup_1h:max
+func parseDownsampling(s string) ([]*timeseries.DownsamplingConfiguration, error) {
+	var tiers []*timeseries.DownsamplingConfiguration
+	if s == "" {
+		return tiers, nil
+	}
+	for _, def := range strings.Split(s, ",") {
+		kv := strings.SplitN(def, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid downsampling tier %q, expected interval=rp[:function]", def)
+		}
+		interval, err := time.ParseDuration(kv[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid downsampling tier %q: %s", def, err)
+		}
+		v := strings.SplitN(kv[1], ":", 2)
+		tier := &timeseries.DownsamplingConfiguration{Interval: interval, RetentionPolicy: v[0]}
+		if len(v) == 2 {
+			tier.Function = v[1]
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+// Parses a comma-separated list of key=value pairs
+func parseKeyValues(s string) (map[string]string, error) {
+	kvs := make(map[string]string)
+	if s == "" {
+		return kvs, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		kvs[kv[0]] = kv[1]
+	}
+	return kvs, nil
 }
@@ -0,0 +1,167 @@
+package natsserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+)
+
+const (
+	ADDR             = ":4222"
+	START_TIMEOUT_MS = 5000 // time allowed for the server to listen
+)
+
+type Configuration struct {
+	// host:port to listen on for clients, defaults to ADDR, all interfaces
+	// when the host is left out
+	Addr string
+	// credentials clients must authenticate with, none when empty
+	User     string
+	Password string
+	// port of the HTTP monitoring endpoints, on the same host, disabled when 0
+	HTTPPort int
+}
+
+// Checks the addresses and fills in defaults for settings left empty
+func (config *Configuration) Validate() error {
+	if config.Addr == "" {
+		config.Addr = ADDR
+	}
+	if _, _, err := config.hostPort(); err != nil {
+		return fmt.Errorf("invalid embedded NATS server address %q: %s", config.Addr, err)
+	}
+	if config.Password != "" && config.User == "" {
+		return errors.New("embedded NATS server password requires a user")
+	}
+	if config.HTTPPort < 0 {
+		return fmt.Errorf("invalid embedded NATS server monitoring port %d", config.HTTPPort)
+	}
+	return nil
+}
+
+func (config *Configuration) hostPort() (string, int, error) {
+	host, p, err := net.SplitHostPort(config.Addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 {
+		return "", 0, fmt.Errorf("invalid port %q", p)
+	}
+	if host == "" {
+		host = server.DEFAULT_HOST
+	}
+	return host, port, nil
+}
+
+// Address clients running on the same host connect to
+func (config *Configuration) ClientAddr() string {
+	host, port, _ := config.hostPort()
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// A NATS server running in-process, so that metricas can be deployed as a
+// single binary
+type Server struct {
+	*server.Server
+	errs chan error
+}
+
+// Starts the server, returning once it listens for clients
+func Start(config *Configuration) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	host, port, _ := config.hostPort()
+	opts := &server.Options{
+		Host:     host,
+		Port:     port,
+		HTTPPort: config.HTTPPort,
+		Username: config.User,
+		Password: config.Password,
+		// metricas handles signals itself
+		NoSigs: true,
+	}
+	// the server does not report failing to listen, so ports are checked first
+	if err := checkListen(host, port); err != nil {
+		return nil, err
+	}
+	if config.HTTPPort != 0 {
+		if err := checkListen(host, config.HTTPPort); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		Server: server.New(opts),
+		errs:   make(chan error, 1),
+	}
+	s.SetLogger(s, false, false)
+	if config.User != "" {
+		s.SetAuthMethod(&plainAuth{user: config.User, password: config.Password})
+	}
+	go s.Server.Start()
+
+	timeout := time.After(START_TIMEOUT_MS * time.Millisecond)
+	for s.Addr() == nil {
+		select {
+		case err := <-s.errs:
+			s.Shutdown()
+			return nil, err
+		case <-timeout:
+			s.Shutdown()
+			return nil, fmt.Errorf("embedded NATS server not listening on %s after %dms", config.Addr, START_TIMEOUT_MS)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return s, nil
+}
+
+func checkListen(host string, port int) error {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("embedded NATS server: %s", err)
+	}
+	return l.Close()
+}
+
+// Logs what the server notices, errors included, as the rest of metricas
+func (s *Server) Noticef(format string, v ...interface{}) {
+	log.Printf("NATS server: "+format, v...)
+}
+
+func (s *Server) Errorf(format string, v ...interface{}) {
+	log.Printf("NATS server error: "+format, v...)
+}
+
+// Fatal errors make Start fail instead of exiting
+func (s *Server) Fatalf(format string, v ...interface{}) {
+	select {
+	case s.errs <- fmt.Errorf("embedded NATS server: "+format, v...):
+	default:
+	}
+	s.Errorf(format, v...)
+}
+
+func (s *Server) Debugf(format string, v ...interface{}) {}
+
+func (s *Server) Tracef(format string, v ...interface{}) {}
+
+// Authenticates clients with a single user and password
+type plainAuth struct {
+	user     string
+	password string
+}
+
+func (a *plainAuth) Check(c server.ClientAuth) bool {
+	opts := c.GetOpts()
+	return opts.Username == a.user && opts.Password == a.password
+}
@@ -0,0 +1,271 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pires/metricas/processor"
+	"github.com/pires/metricas/timeseries"
+)
+
+type Configuration struct {
+	// sinks points are routed to, by name
+	Outputs []*timeseries.SinkConfiguration
+	// processor chains routes may run points through, by name
+	Chains map[string][]*processor.Configuration
+	// points take the first route matching their source, and are dropped when
+	// none does. Without routes, points are written to every output.
+	Routes []*RouteConfiguration
+}
+
+type RouteConfiguration struct {
+	// patterns matched against the source of points, i.e. the NATS subject
+	// they were received on or the name of the input that emitted them, with
+	// NATS wildcards, e.g. metrics.billing.>. A route without patterns
+	// matches every point.
+	Match []string
+	// name of the chain points are run through, none when empty
+	Processors string
+	// names of the outputs points are written to
+	Outputs []string
+}
+
+// Routes points to named outputs through named processor chains. It is itself
+// a sink, so that the service writes to it like to any other.
+type Pipeline struct {
+	outputs  []timeseries.Sink
+	names    []string
+	routes   []*route
+	unrouted uint64 // updated atomically
+}
+
+type route struct {
+	match      [][]string // patterns, split into tokens
+	processors processor.Chain
+	outputs    []int // indexes into Pipeline.outputs
+}
+
+func New(config *Configuration) (*Pipeline, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	p := &Pipeline{}
+	indexes := make(map[string]int, len(config.Outputs))
+	for i, outputConfig := range config.Outputs {
+		sink, err := timeseries.NewSink(outputConfig)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("output %s: %s", outputConfig.Name, err)
+		}
+		p.outputs = append(p.outputs, sink)
+		p.names = append(p.names, outputConfig.Name)
+		indexes[outputConfig.Name] = i
+	}
+
+	routes := config.Routes
+	if len(routes) == 0 {
+		routes = []*RouteConfiguration{{Outputs: p.names}}
+	}
+	for _, routeConfig := range routes {
+		r := &route{}
+		for _, pattern := range routeConfig.Match {
+			r.match = append(r.match, strings.Split(pattern, "."))
+		}
+		if routeConfig.Processors != "" {
+			// validated already
+			r.processors, _ = processor.NewChain(config.Chains[routeConfig.Processors])
+		}
+		for _, name := range routeConfig.Outputs {
+			r.outputs = append(r.outputs, indexes[name])
+		}
+		p.routes = append(p.routes, r)
+	}
+
+	return p, nil
+}
+
+// Checks outputs are named and exist, as well as the chains routes refer to
+func (config *Configuration) Validate() error {
+	if len(config.Outputs) == 0 {
+		return errors.New("pipeline needs at least one output")
+	}
+	outputs := make(map[string]bool, len(config.Outputs))
+	for _, outputConfig := range config.Outputs {
+		if outputConfig.Name == "" {
+			return errors.New("outputs must be named")
+		}
+		if outputs[outputConfig.Name] {
+			return fmt.Errorf("output %s defined twice", outputConfig.Name)
+		}
+		outputs[outputConfig.Name] = true
+		if err := outputConfig.Validate(); err != nil {
+			return fmt.Errorf("output %s: %s", outputConfig.Name, err)
+		}
+	}
+	for name, chain := range config.Chains {
+		if _, err := processor.NewChain(chain); err != nil {
+			return fmt.Errorf("chain %s: %s", name, err)
+		}
+	}
+	for i, routeConfig := range config.Routes {
+		if len(routeConfig.Outputs) == 0 {
+			return fmt.Errorf("route %d: no outputs", i)
+		}
+		for _, pattern := range routeConfig.Match {
+			if !validPattern(pattern) {
+				return fmt.Errorf("route %d: invalid pattern %q", i, pattern)
+			}
+		}
+		if _, ok := config.Chains[routeConfig.Processors]; routeConfig.Processors != "" && !ok {
+			return fmt.Errorf("route %d: unknown chain %s", i, routeConfig.Processors)
+		}
+		for _, name := range routeConfig.Outputs {
+			if !outputs[name] {
+				return fmt.Errorf("route %d: unknown output %s", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Writes the point to the outputs of the first route matching its source
+func (p *Pipeline) Write(point *timeseries.Point) error {
+	r := p.route(point.Source)
+	if r == nil {
+		atomic.AddUint64(&p.unrouted, 1)
+		return nil
+	}
+	if point = r.processors.Process(point); point == nil {
+		return nil
+	}
+	var lastErr error
+	for _, i := range r.outputs {
+		if err := p.outputs[i].Write(point); err != nil {
+			lastErr = fmt.Errorf("output %s: %s", p.names[i], err)
+		}
+	}
+	return lastErr
+}
+
+func (p *Pipeline) route(source string) *route {
+	tokens := strings.Split(source, ".")
+	for _, r := range p.routes {
+		if len(r.match) == 0 {
+			return r
+		}
+		for _, pattern := range r.match {
+			if matchTokens(pattern, tokens) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline) Flush() error {
+	return p.each(func(sink timeseries.Sink) error {
+		return sink.Flush()
+	})
+}
+
+func (p *Pipeline) Close() error {
+	return p.each(func(sink timeseries.Sink) error {
+		return sink.Close()
+	})
+}
+
+// Pings all outputs able to, returning the last error
+func (p *Pipeline) Ping() error {
+	return p.each(func(sink timeseries.Sink) error {
+		if pinger, ok := sink.(timeseries.Pinger); ok {
+			return pinger.Ping()
+		}
+		return nil
+	})
+}
+
+func (p *Pipeline) ReportErrors(report func(error)) {
+	for _, sink := range p.outputs {
+		if r, ok := sink.(timeseries.ErrorReporter); ok {
+			r.ReportErrors(report)
+		}
+	}
+}
+
+func (p *Pipeline) Pause() {
+	for _, sink := range p.outputs {
+		if pauser, ok := sink.(timeseries.Pauser); ok {
+			pauser.Pause()
+		}
+	}
+}
+
+func (p *Pipeline) Resume() {
+	for _, sink := range p.outputs {
+		if pauser, ok := sink.(timeseries.Pauser); ok {
+			pauser.Resume()
+		}
+	}
+}
+
+// Aggregated statistics of all outputs, points matching no route counted as
+// dropped
+func (p *Pipeline) Stats() timeseries.Stats {
+	var total timeseries.Stats
+	for _, stats := range p.BackendStats() {
+		total.Add(stats)
+	}
+	total.Dropped += atomic.LoadUint64(&p.unrouted)
+	return total
+}
+
+// Statistics of each output, by name
+func (p *Pipeline) BackendStats() map[string]timeseries.Stats {
+	stats := make(map[string]timeseries.Stats, len(p.outputs))
+	for i, sink := range p.outputs {
+		if r, ok := sink.(timeseries.StatsReporter); ok {
+			stats[p.names[i]] = r.Stats()
+		} else {
+			stats[p.names[i]] = timeseries.Stats{}
+		}
+	}
+	return stats
+}
+
+// Runs f for every output, returning the last error
+func (p *Pipeline) each(f func(sink timeseries.Sink) error) error {
+	var lastErr error
+	for i, sink := range p.outputs {
+		if err := f(sink); err != nil {
+			lastErr = fmt.Errorf("output %s: %s", p.names[i], err)
+		}
+	}
+	return lastErr
+}
+
+// Patterns are NATS subjects, where * matches a token and a trailing > matches
+// one or more tokens
+func validPattern(pattern string) bool {
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		if token == "" || (token == ">" && i != len(tokens)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchTokens(pattern, tokens []string) bool {
+	for i, p := range pattern {
+		if p == ">" {
+			return len(tokens) > i
+		}
+		if i >= len(tokens) || (p != "*" && p != tokens[i]) {
+			return false
+		}
+	}
+	return len(tokens) == len(pattern)
+}
@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+func TestValidPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"metrics", true},
+		{"metrics.billing", true},
+		{"metrics.*", true},
+		{"*.billing.*", true},
+		{"metrics.>", true},
+		{">", true},
+		{"", false},
+		{"metrics.", false},
+		{".metrics", false},
+		{"metrics..billing", false},
+		{"metrics.>.billing", false},
+		{">.metrics", false},
+	}
+	for _, test := range tests {
+		if valid := validPattern(test.pattern); valid != test.valid {
+			t.Errorf("%q: valid %t, expected %t", test.pattern, valid, test.valid)
+		}
+	}
+}
+
+func TestMatchTokens(t *testing.T) {
+	tests := []struct {
+		pattern string
+		source  string
+		match   bool
+	}{
+		{"metrics", "metrics", true},
+		{"metrics", "metrics.billing", false},
+		{"metrics.billing", "metrics", false},
+		{"metrics.billing", "metrics.billing", true},
+		{"metrics.billing", "metrics.orders", false},
+		{"metrics.*", "metrics.billing", true},
+		{"metrics.*", "metrics", false},
+		{"metrics.*", "metrics.billing.eu", false},
+		{"*.billing", "metrics.billing", true},
+		{"*.billing", "events.billing", true},
+		{"*.*", "statsd", false},
+		{"metrics.>", "metrics.billing", true},
+		{"metrics.>", "metrics.billing.eu", true},
+		{"metrics.>", "metrics", false},
+		{"metrics.*.>", "metrics.billing", false},
+		{"metrics.*.>", "metrics.billing.eu", true},
+		{">", "statsd", true},
+		{">", "metrics.billing", true},
+	}
+	for _, test := range tests {
+		match := matchTokens(strings.Split(test.pattern, "."), strings.Split(test.source, "."))
+		if match != test.match {
+			t.Errorf("%q against %q: match %t, expected %t", test.pattern, test.source, match, test.match)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	p := &Pipeline{}
+	for _, patterns := range [][]string{
+		{"metrics.billing.>"},
+		{"metrics.*", "statsd"},
+		{"metrics.>"},
+	} {
+		r := &route{}
+		for _, pattern := range patterns {
+			r.match = append(r.match, strings.Split(pattern, "."))
+		}
+		p.routes = append(p.routes, r)
+	}
+
+	tests := []struct {
+		source string
+		route  int // index of the route taken, -1 for none
+	}{
+		{"metrics.billing.eu", 0},
+		{"metrics.billing", 1},
+		{"metrics.orders", 1},
+		{"statsd", 1},
+		{"metrics.orders.eu", 2},
+		{"metrics", -1},
+		{"http", -1},
+		{"", -1},
+	}
+	for _, test := range tests {
+		r := p.route(test.source)
+		taken := -1
+		for i := range p.routes {
+			if p.routes[i] == r {
+				taken = i
+			}
+		}
+		if taken != test.route {
+			t.Errorf("%q: route %d, expected %d", test.source, taken, test.route)
+		}
+	}
+
+	// a route without patterns matches every point
+	p.routes = append(p.routes, &route{})
+	if r := p.route("http"); r != p.routes[3] {
+		t.Errorf("points matching no pattern not taking the route without patterns")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	outputs := func() []*timeseries.SinkConfiguration {
+		return []*timeseries.SinkConfiguration{
+			{Name: "a", Type: timeseries.SINK_FILE, File: &timeseries.FileConfiguration{Path: "a.lp"}},
+			{Name: "b", Type: timeseries.SINK_FILE, File: &timeseries.FileConfiguration{Path: "b.lp"}},
+		}
+	}
+	tests := []struct {
+		name   string
+		config *Configuration
+		err    string
+	}{
+		{
+			name:   "valid",
+			config: &Configuration{Outputs: outputs(), Routes: []*RouteConfiguration{{Match: []string{"metrics.>"}, Outputs: []string{"a", "b"}}}},
+		},
+		{
+			name:   "without routes",
+			config: &Configuration{Outputs: outputs()},
+		},
+		{
+			name:   "without outputs",
+			config: &Configuration{},
+			err:    "pipeline needs at least one output",
+		},
+		{
+			name:   "unnamed output",
+			config: &Configuration{Outputs: append(outputs(), &timeseries.SinkConfiguration{Type: timeseries.SINK_FILE})},
+			err:    "outputs must be named",
+		},
+		{
+			name:   "output defined twice",
+			config: &Configuration{Outputs: append(outputs(), outputs()[0])},
+			err:    "output a defined twice",
+		},
+		{
+			name:   "route without outputs",
+			config: &Configuration{Outputs: outputs(), Routes: []*RouteConfiguration{{Match: []string{"metrics"}}}},
+			err:    "route 0: no outputs",
+		},
+		{
+			name:   "invalid pattern",
+			config: &Configuration{Outputs: outputs(), Routes: []*RouteConfiguration{{Outputs: []string{"a"}}, {Match: []string{"metrics.>.eu"}, Outputs: []string{"a"}}}},
+			err:    `route 1: invalid pattern "metrics.>.eu"`,
+		},
+		{
+			name:   "unknown chain",
+			config: &Configuration{Outputs: outputs(), Routes: []*RouteConfiguration{{Processors: "billing", Outputs: []string{"a"}}}},
+			err:    "route 0: unknown chain billing",
+		},
+		{
+			name:   "unknown output",
+			config: &Configuration{Outputs: outputs(), Routes: []*RouteConfiguration{{Outputs: []string{"a", "c"}}}},
+			err:    "route 0: unknown output c",
+		},
+	}
+	for _, test := range tests {
+		err := test.config.Validate()
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: error %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	PROCESSOR_CARDINALITY = "cardinality"
+
+	CARDINALITY_WINDOW = 24 * time.Hour // how long distinct series and tag values are remembered
+
+	CARDINALITY_STRIP = "strip" // remove tags over the limit
+	CARDINALITY_DROP  = "drop"  // drop points over the limit
+)
+
+func init() {
+	RegisterProcessor(PROCESSOR_CARDINALITY, NewCardinality)
+}
+
+// Guards against series explosions, e.g. request IDs sent as tags, by
+// tracking distinct series per measurement and distinct values per tag key of
+// a measurement. Known series and values always pass, new ones only until the
+// limit is reached. Options:
+//
+//	max_series  distinct series per measurement
+//	max_values  distinct values per tag key of a measurement
+//	action      strip (default), removing tags over the limit, or drop,
+//	            dropping points over the limit
+//	window      how long series and values are remembered, defaults to
+//	            CARDINALITY_WINDOW, after which limits start over
+//
+// A new series over max_series is stripped of the tag with the most distinct
+// values until it is a known series, or dropped, and counted as such, when it
+// is still unknown once stripped of all its tags. Limited points are counted
+// by measurement and tag, the widest tag of dropped series, as
+// metricas_cardinality.
+type cardinality struct {
+	maxSeries int
+	maxValues int
+	drop      bool
+	window    time.Duration
+
+	mu           sync.Mutex
+	expires      time.Time
+	measurements map[string]*measurementCardinality
+}
+
+type measurementCardinality struct {
+	series map[string]struct{}
+	values map[string]map[string]struct{} // by tag key
+	alerts map[string]*cardinalityAlert   // by tag key
+}
+
+type cardinalityAlert struct {
+	stripped *instrument.Counter
+	dropped  *instrument.Counter
+}
+
+func NewCardinality(config *Configuration) (Processor, error) {
+	c := &cardinality{
+		window:       CARDINALITY_WINDOW,
+		measurements: make(map[string]*measurementCardinality),
+	}
+	for k, v := range config.Options {
+		var err error
+		switch k {
+		case "max_series":
+			c.maxSeries, err = strconv.Atoi(v)
+		case "max_values":
+			c.maxValues, err = strconv.Atoi(v)
+		case "window":
+			c.window, err = time.ParseDuration(v)
+		case "action":
+			switch v {
+			case CARDINALITY_STRIP:
+			case CARDINALITY_DROP:
+				c.drop = true
+			default:
+				err = errors.New("must be one of strip or drop")
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", k, v, err)
+		}
+	}
+	if c.maxSeries < 0 || c.maxValues < 0 || c.window <= 0 {
+		return nil, errors.New("limits and window must be positive")
+	}
+	if c.maxSeries == 0 && c.maxValues == 0 {
+		return nil, errors.New("missing max_series or max_values")
+	}
+	return c, nil
+}
+
+func (c *cardinality) Process(point *timeseries.Point) *timeseries.Point {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.After(c.expires) {
+		c.measurements = make(map[string]*measurementCardinality)
+		c.expires = now.Add(c.window)
+	}
+	m, ok := c.measurements[point.Measurement]
+	if !ok {
+		m = &measurementCardinality{
+			series: make(map[string]struct{}),
+			values: make(map[string]map[string]struct{}),
+			alerts: make(map[string]*cardinalityAlert),
+		}
+		c.measurements[point.Measurement] = m
+	}
+
+	// tags over their limit of distinct values, which are tracked regardless
+	// to find the widest tag of series over max_series
+	var over []string
+	for k, v := range point.Tags {
+		values, ok := m.values[k]
+		if !ok {
+			values = make(map[string]struct{})
+			m.values[k] = values
+		}
+		if _, ok := values[v]; ok {
+			continue
+		}
+		if c.maxValues == 0 || len(values) < c.maxValues {
+			values[v] = struct{}{}
+			continue
+		}
+		over = append(over, k)
+	}
+	if len(over) > 0 {
+		if c.drop {
+			c.alert(m, point.Measurement, over[0]).dropped.Inc()
+			return nil
+		}
+		point = strip(point, over...)
+		for _, k := range over {
+			c.alert(m, point.Measurement, k).stripped.Inc()
+		}
+	}
+
+	if c.maxSeries == 0 {
+		return point
+	}
+	series := point.Series()
+	if _, ok := m.series[series]; ok {
+		return point
+	}
+	if len(m.series) < c.maxSeries {
+		m.series[series] = struct{}{}
+		return point
+	}
+	// over the limit, the tag with the most distinct values is the likeliest
+	// culprit
+	culprit := m.widestTag(point.Tags)
+	if c.drop {
+		c.alert(m, point.Measurement, culprit).dropped.Inc()
+		return nil
+	}
+	var stripped []string
+	for len(point.Tags) > 0 {
+		k := m.widestTag(point.Tags)
+		point = strip(point, k)
+		stripped = append(stripped, k)
+		if _, ok := m.series[point.Series()]; ok {
+			for _, k := range stripped {
+				c.alert(m, point.Measurement, k).stripped.Inc()
+			}
+			return point
+		}
+	}
+	// no series is left to stripping
+	c.alert(m, point.Measurement, culprit).dropped.Inc()
+	return nil
+}
+
+// Returns the tag key of the point with the most distinct values
+func (m *measurementCardinality) widestTag(tags map[string]string) string {
+	widest, n := "", -1
+	for k := range tags {
+		if len(m.values[k]) > n || (len(m.values[k]) == n && k < widest) {
+			widest, n = k, len(m.values[k])
+		}
+	}
+	return widest
+}
+
+// Returns the counters of points limited because of the given tag, logging
+// the first time the limit is reached
+func (c *cardinality) alert(m *measurementCardinality, measurement, tag string) *cardinalityAlert {
+	a, ok := m.alerts[tag]
+	if !ok {
+		log.Printf("Measurement %s reached its cardinality limit because of tag %s, limiting its points.", measurement, tag)
+		tags := map[string]string{"measurement": measurement, "tag": tag}
+		a = &cardinalityAlert{
+			stripped: instrument.Default.Counter("metricas_cardinality", tags, "points_stripped"),
+			dropped:  instrument.Default.Counter("metricas_cardinality", tags, "points_dropped"),
+		}
+		m.alerts[tag] = a
+	}
+	return a
+}
+
+// Returns a copy of the point without the given tags
+func strip(point *timeseries.Point, keys ...string) *timeseries.Point {
+	p := *point
+	p.Tags = make(map[string]string, len(point.Tags))
+	for k, v := range point.Tags {
+		p.Tags[k] = v
+	}
+	for _, k := range keys {
+		delete(p.Tags, k)
+	}
+	return &p
+}
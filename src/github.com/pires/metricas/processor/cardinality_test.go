@@ -0,0 +1,103 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/timeseries"
+)
+
+func TestCardinalityMaxSeries(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   string
+		tags     map[string]string
+		kept     map[string]string // tags of the point passed, nil when dropped
+		stripped uint64
+		dropped  uint64
+	}{
+		{
+			name: "known series",
+			tags: map[string]string{"host": "a", "request": "1"},
+			kept: map[string]string{"host": "a", "request": "1"},
+		},
+		{
+			name:     "stripped into a known series",
+			tags:     map[string]string{"host": "b", "request": "9"},
+			kept:     map[string]string{"host": "b"},
+			stripped: 1,
+		},
+		{
+			name:    "stripped of all tags",
+			tags:    map[string]string{"host": "c", "request": "9"},
+			dropped: 1,
+		},
+		{
+			name:    "dropped",
+			action:  CARDINALITY_DROP,
+			tags:    map[string]string{"host": "b", "request": "9"},
+			dropped: 1,
+		},
+	}
+	for _, test := range tests {
+		measurement := "cardinality_" + test.action + "_" + test.name
+		options := map[string]string{"max_series": "4"}
+		if test.action != "" {
+			options["action"] = test.action
+		}
+		p, err := NewCardinality(&Configuration{Options: options})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// known series, request being the widest tag
+		for _, tags := range []map[string]string{
+			{"host": "a", "request": "1"},
+			{"host": "a", "request": "2"},
+			{"host": "a", "request": "3"},
+			{"host": "b"},
+		} {
+			if p.Process(&timeseries.Point{Measurement: measurement, Tags: tags}) == nil {
+				t.Fatalf("%s: point of series %v dropped under the limit", test.name, tags)
+			}
+		}
+
+		// counters outlive the processor, e.g. when tests run again
+		tags := map[string]string{"measurement": measurement, "tag": "request"}
+		stripped := instrument.Default.Counter("metricas_cardinality", tags, "points_stripped")
+		dropped := instrument.Default.Counter("metricas_cardinality", tags, "points_dropped")
+		hostTags := map[string]string{"measurement": measurement, "tag": "host"}
+		hostStripped := instrument.Default.Counter("metricas_cardinality", hostTags, "points_stripped")
+		strippedBefore, droppedBefore, hostBefore := stripped.Value(), dropped.Value(), hostStripped.Value()
+
+		point := p.Process(&timeseries.Point{Measurement: measurement, Tags: test.tags})
+		switch {
+		case test.kept == nil && point != nil:
+			t.Errorf("%s: point kept with tags %v, want dropped", test.name, point.Tags)
+		case test.kept != nil && point == nil:
+			t.Errorf("%s: point dropped, want kept with tags %v", test.name, test.kept)
+		case test.kept != nil && len(point.Tags) != len(test.kept):
+			t.Errorf("%s: point kept with tags %v, want %v", test.name, point.Tags, test.kept)
+		}
+		if n := stripped.Value() - strippedBefore; n != test.stripped {
+			t.Errorf("%s: %d points stripped, want %d", test.name, n, test.stripped)
+		}
+		if n := dropped.Value() - droppedBefore; n != test.dropped {
+			t.Errorf("%s: %d points dropped, want %d", test.name, n, test.dropped)
+		}
+		if n := hostStripped.Value() - hostBefore; n != 0 {
+			t.Errorf("%s: %d points stripped of host, want 0", test.name, n)
+		}
+	}
+}
+
+func TestCardinalityMaxValues(t *testing.T) {
+	p, err := NewCardinality(&Configuration{Options: map[string]string{"max_values": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Process(&timeseries.Point{Measurement: "values", Tags: map[string]string{"host": "a", "dc": "eu"}})
+	point := p.Process(&timeseries.Point{Measurement: "values", Tags: map[string]string{"host": "b", "dc": "eu"}})
+	if point == nil || len(point.Tags) != 1 || point.Tags["dc"] != "eu" {
+		t.Errorf("got %v, want the point stripped of host", point)
+	}
+}
@@ -0,0 +1,145 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	PROCESSOR_DEDUP = "dedup"
+
+	DEDUP_WINDOW   = 10 * time.Minute // how long points are remembered
+	DEDUP_MAX_KEYS = 1000000          // points remembered at most
+
+	DEDUP_SERIES   = "series"   // points are identified by series, time and field keys
+	DEDUP_SEQUENCE = "sequence" // points are identified by producer and sequence number
+)
+
+func init() {
+	RegisterProcessor(PROCESSOR_DEDUP, NewDedup)
+}
+
+// Drops points already seen, e.g. resent by producers retrying after a
+// timeout. Options:
+//
+//	key       series (default), identifying points by series, time and
+//	          field keys, or sequence, by producer ID and sequence number,
+//	          falling back to series for points without them
+//	window    how long points are remembered, defaults to DEDUP_WINDOW
+//	max_keys  points remembered at most, defaults to DEDUP_MAX_KEYS
+//
+// Points are remembered for at least window, unless over max_keys/2 points
+// arrive within it, and at most twice as long. Points without time, left to
+// be timestamped by InfluxDB, are never duplicates. Dropped points are counted
+// by source as metricas_dedup.
+type dedup struct {
+	sequence bool
+	window   time.Duration
+	maxKeys  int
+
+	mu       sync.Mutex
+	current  map[string]struct{}
+	previous map[string]struct{}
+	rotated  time.Time
+	dropped  map[string]*instrument.Counter // by source
+}
+
+func NewDedup(config *Configuration) (Processor, error) {
+	d := &dedup{
+		window:   DEDUP_WINDOW,
+		maxKeys:  DEDUP_MAX_KEYS,
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+		rotated:  time.Now(),
+		dropped:  make(map[string]*instrument.Counter),
+	}
+	for k, v := range config.Options {
+		var err error
+		switch k {
+		case "window":
+			d.window, err = time.ParseDuration(v)
+		case "max_keys":
+			d.maxKeys, err = strconv.Atoi(v)
+		case "key":
+			switch v {
+			case DEDUP_SERIES:
+			case DEDUP_SEQUENCE:
+				d.sequence = true
+			default:
+				err = errors.New("must be one of series or sequence")
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", k, v, err)
+		}
+	}
+	if d.window <= 0 || d.maxKeys < 2 {
+		return nil, errors.New("window must be positive and max_keys at least 2")
+	}
+	return d, nil
+}
+
+func (d *dedup) Process(point *timeseries.Point) *timeseries.Point {
+	key := d.key(point)
+	if key == "" {
+		return point
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// two generations of points, so that forgetting the older one still
+	// leaves the last window remembered
+	if now := time.Now(); now.Sub(d.rotated) >= d.window || len(d.current) >= d.maxKeys/2 {
+		d.previous = d.current
+		d.current = make(map[string]struct{}, len(d.previous))
+		d.rotated = now
+	}
+	_, seen := d.current[key]
+	if !seen {
+		_, seen = d.previous[key]
+	}
+	if !seen {
+		d.current[key] = struct{}{}
+		return point
+	}
+	dropped, ok := d.dropped[point.Source]
+	if !ok {
+		log.Printf("Source %s resent points, dropping duplicates.", point.Source)
+		tags := map[string]string{"source": point.Source}
+		dropped = instrument.Default.Counter("metricas_dedup", tags, "points_dropped")
+		d.dropped[point.Source] = dropped
+	}
+	dropped.Inc()
+	return nil
+}
+
+// Returns what identifies the point, or an empty string if nothing does
+func (d *dedup) key(point *timeseries.Point) string {
+	if d.sequence && point.Producer != "" && point.Sequence != 0 {
+		return "p" + point.Producer + "\x00" + strconv.FormatUint(point.Sequence, 10)
+	}
+	if point.Time.IsZero() {
+		return ""
+	}
+	// points of a series at the same time with other fields are merged by
+	// InfluxDB, not duplicates
+	fields := make([]string, 0, len(point.Fields))
+	for k := range point.Fields {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	key := "s" + point.Series() + "\x00" + strconv.FormatInt(point.Time.UnixNano(), 10)
+	for _, k := range fields {
+		key += "\x00" + k
+	}
+	return key
+}
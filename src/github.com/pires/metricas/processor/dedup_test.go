@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+func TestDedupKey(t *testing.T) {
+	at := time.Unix(1434055562, 0)
+	point := func(host string, t time.Time, fields ...string) *timeseries.Point {
+		p := &timeseries.Point{
+			Measurement: "cpu",
+			Tags:        map[string]string{"host": host},
+			Fields:      make(map[string]interface{}),
+			Time:        t,
+			Source:      "metrics",
+		}
+		for _, f := range fields {
+			p.Fields[f] = 1.0
+		}
+		return p
+	}
+	sequenced := func(p *timeseries.Point, producer string, seq uint64) *timeseries.Point {
+		p.Producer, p.Sequence = producer, seq
+		return p
+	}
+	tests := []struct {
+		name   string
+		key    string
+		first  *timeseries.Point
+		second *timeseries.Point
+		dup    bool
+	}{
+		{"same point", "", point("a", at, "value"), point("a", at, "value"), true},
+		{"same point, fields in another order", "", point("a", at, "user", "system"), point("a", at, "system", "user"), true},
+		{"other series", "", point("a", at, "value"), point("b", at, "value"), false},
+		{"other time", "", point("a", at, "value"), point("a", at.Add(time.Second), "value"), false},
+		{"other fields", "", point("a", at, "user"), point("a", at, "system"), false},
+		{"without time", "", point("a", time.Time{}, "value"), point("a", time.Time{}, "value"), false},
+		{"same sequence", DEDUP_SEQUENCE, sequenced(point("a", at, "value"), "p1", 7), sequenced(point("a", at.Add(time.Second), "value"), "p1", 7), true},
+		{"other sequence", DEDUP_SEQUENCE, sequenced(point("a", at, "value"), "p1", 7), sequenced(point("a", at, "value"), "p1", 8), false},
+		{"other producer", DEDUP_SEQUENCE, sequenced(point("a", at, "value"), "p1", 7), sequenced(point("a", at, "value"), "p2", 7), false},
+		{"unsequenced, same point", DEDUP_SEQUENCE, point("a", at, "value"), point("a", at, "value"), true},
+		{"sequence ignored by series", DEDUP_SERIES, sequenced(point("a", at, "value"), "p1", 7), sequenced(point("a", at, "value"), "p1", 8), true},
+	}
+	for _, test := range tests {
+		options := make(map[string]string)
+		if test.key != "" {
+			options["key"] = test.key
+		}
+		p, err := NewDedup(&Configuration{Options: options})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Process(test.first) == nil {
+			t.Errorf("%s: first point dropped", test.name)
+		}
+		if dup := p.Process(test.second) == nil; dup != test.dup {
+			t.Errorf("%s: second point dropped %t, want %t", test.name, dup, test.dup)
+		}
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	p, err := NewDedup(&Configuration{Options: map[string]string{"window": "30ms"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := &timeseries.Point{Measurement: "cpu", Fields: map[string]interface{}{"value": 1.0}, Time: time.Unix(1434055562, 0)}
+	p.Process(point)
+	// remembered for at least the window
+	time.Sleep(40 * time.Millisecond)
+	if p.Process(point) != nil {
+		t.Error("point forgotten within twice the window")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if p.Process(point) == nil {
+		t.Error("point remembered after twice the window")
+	}
+}
+
+func TestDedupMaxKeys(t *testing.T) {
+	p, err := NewDedup(&Configuration{Options: map[string]string{"max_keys": "4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := make([]*timeseries.Point, 5)
+	for i := range points {
+		points[i] = &timeseries.Point{Measurement: "cpu", Fields: map[string]interface{}{"value": 1.0}, Time: time.Unix(int64(i), 0)}
+		p.Process(points[i])
+	}
+	// generations of max_keys/2 points, the oldest forgotten, checked from
+	// the newest since points kept again are remembered
+	for i := len(points) - 1; i >= 0; i-- {
+		forgotten := i < 2
+		if kept := p.Process(points[i]) != nil; kept != forgotten {
+			t.Errorf("point %d kept %t, want %t", i, kept, forgotten)
+		}
+	}
+}
+
+func TestDedupOptions(t *testing.T) {
+	tests := []struct {
+		options map[string]string
+		valid   bool
+	}{
+		{map[string]string{}, true},
+		{map[string]string{"key": "sequence", "window": "1m", "max_keys": "10"}, true},
+		{map[string]string{"key": "producer"}, false},
+		{map[string]string{"window": "0s"}, false},
+		{map[string]string{"max_keys": "1"}, false},
+		{map[string]string{"size": "10"}, false},
+	}
+	for _, test := range tests {
+		if _, err := NewDedup(&Configuration{Options: test.options}); (err == nil) != test.valid {
+			t.Errorf("%v: got error %v, want valid %t", test.options, err, test.valid)
+		}
+	}
+}
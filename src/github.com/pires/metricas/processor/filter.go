@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	PROCESSOR_FILTER = "filter"
+)
+
+func init() {
+	RegisterProcessor(PROCESSOR_FILTER, NewFilter)
+}
+
+// Keeps or drops points by measurement name. Options:
+//
+//	include  comma-separated patterns, only matching measurements are kept
+//	exclude  comma-separated patterns, matching measurements are dropped
+//
+// Patterns are matched with path.Match, e.g. cpu_* or disk_?
+type filter struct {
+	include []string
+	exclude []string
+}
+
+func NewFilter(config *Configuration) (Processor, error) {
+	f := &filter{
+		include: splitList(config.Options["include"]),
+		exclude: splitList(config.Options["exclude"]),
+	}
+	for _, pattern := range append(f.include, f.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	for k := range config.Options {
+		if k != "include" && k != "exclude" {
+			return nil, fmt.Errorf("unknown option %q", k)
+		}
+	}
+	return f, nil
+}
+
+func (f *filter) Process(point *timeseries.Point) *timeseries.Point {
+	if len(f.include) > 0 && !matchAny(f.include, point.Measurement) {
+		return nil
+	}
+	if matchAny(f.exclude, point.Measurement) {
+		return nil
+	}
+	return point
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a comma-separated list, ignoring empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
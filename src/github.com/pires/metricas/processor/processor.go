@@ -0,0 +1,80 @@
+package processor
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+// A Processor transforms or filters points on their way to the sink. Points
+// may be shared, so processors must copy a point before modifying it.
+type Processor interface {
+	// Process returns the point to pass on, or nil to drop it
+	Process(point *timeseries.Point) *timeseries.Point
+}
+
+type Configuration struct {
+	Name    string            // identifies the processor in logs
+	Type    string            // as registered with RegisterProcessor
+	Options map[string]string // settings, depending on the type
+}
+
+// Creates a processor from its configuration
+type ProcessorFactory func(config *Configuration) (Processor, error)
+
+var (
+	processorsMu sync.Mutex
+	processors   = make(map[string]ProcessorFactory)
+)
+
+// Makes a processor type available to NewProcessor. It is meant to be called
+// from the init function of the package implementing the processor.
+func RegisterProcessor(processorType string, factory ProcessorFactory) {
+	processorsMu.Lock()
+	defer processorsMu.Unlock()
+	if _, dup := processors[processorType]; dup {
+		panic("processor: processor " + processorType + " registered twice")
+	}
+	processors[processorType] = factory
+}
+
+// Creates a processor of the configured type
+func NewProcessor(config *Configuration) (Processor, error) {
+	processorsMu.Lock()
+	factory, ok := processors[config.Type]
+	processorsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown processor type %q", config.Type)
+	}
+	return factory(config)
+}
+
+// Runs points through several processors, in order
+type Chain []Processor
+
+// Creates the processors of a chain, in order
+func NewChain(configs []*Configuration) (Chain, error) {
+	chain := make(Chain, 0, len(configs))
+	for i, config := range configs {
+		p, err := NewProcessor(config)
+		if err != nil {
+			name := config.Name
+			if name == "" {
+				name = fmt.Sprintf("%s-%d", config.Type, i)
+			}
+			return nil, fmt.Errorf("processor %s: %s", name, err)
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+func (c Chain) Process(point *timeseries.Point) *timeseries.Point {
+	for _, p := range c {
+		if point = p.Process(point); point == nil {
+			return nil
+		}
+	}
+	return point
+}
@@ -0,0 +1,213 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	PROCESSOR_RATELIMIT = "ratelimit"
+
+	RATELIMIT_IDLE_MS = 60000 // buckets refilled and unused this long are forgotten
+)
+
+func init() {
+	RegisterProcessor(PROCESSOR_RATELIMIT, NewRateLimit)
+}
+
+// Limits the rate of points of each producer with a token bucket, dropping
+// points over the limit. Options:
+//
+//	key        what identifies producers, one of source (default), the NATS
+//	           subject or input name, subject:N, the Nth token of the subject,
+//	           tag:KEY, the value of a tag, or producer, the producer ID of
+//	           NATS metrics or the user of the HTTP input
+//	rate       points per second allowed to each producer
+//	burst      points allowed at once, defaults to rate
+//	overrides  comma-separated key=rate[:burst] limits of given producers
+//
+// Points without identity, e.g. without the tag, are not limited. Throttled
+// points are counted by limiter, the name of the processor, and key as
+// metricas_ratelimit, as long as the producer has a bucket, see
+// RATELIMIT_IDLE_MS, so that the keys of producers going away are not kept.
+type rateLimit struct {
+	name      string
+	key       func(point *timeseries.Point) string
+	limit     bucketLimit
+	overrides map[string]bucketLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	cleaned time.Time
+}
+
+type bucketLimit struct {
+	rate  float64
+	burst float64
+}
+
+type bucket struct {
+	limit     bucketLimit
+	tokens    float64
+	last      time.Time
+	throttled *instrument.Counter
+}
+
+func NewRateLimit(config *Configuration) (Processor, error) {
+	rl := &rateLimit{
+		name:      config.Name,
+		overrides: make(map[string]bucketLimit),
+		buckets:   make(map[string]*bucket),
+		cleaned:   time.Now(),
+	}
+	if rl.name == "" {
+		rl.name = PROCESSOR_RATELIMIT
+	}
+	var err error
+	if rl.key, err = rateLimitKey(config.Options["key"]); err != nil {
+		return nil, err
+	}
+	if rl.limit, err = parseBucketLimit(config.Options["rate"], config.Options["burst"]); err != nil {
+		return nil, err
+	}
+	for _, pair := range splitList(config.Options["overrides"]) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid override %q, expected key=rate[:burst]", pair)
+		}
+		rb := strings.SplitN(kv[1], ":", 2)
+		burst := ""
+		if len(rb) == 2 {
+			burst = rb[1]
+		}
+		if rl.overrides[kv[0]], err = parseBucketLimit(rb[0], burst); err != nil {
+			return nil, fmt.Errorf("override %s: %s", kv[0], err)
+		}
+	}
+	for k := range config.Options {
+		if k != "key" && k != "rate" && k != "burst" && k != "overrides" {
+			return nil, fmt.Errorf("unknown option %q", k)
+		}
+	}
+	return rl, nil
+}
+
+// Returns the function extracting the identity of producers from points
+func rateLimitKey(key string) (func(point *timeseries.Point) string, error) {
+	switch {
+	case key == "" || key == "source":
+		return func(point *timeseries.Point) string { return point.Source }, nil
+	case key == "producer":
+		return func(point *timeseries.Point) string { return point.Producer }, nil
+	case strings.HasPrefix(key, "tag:") && len(key) > len("tag:"):
+		tag := key[len("tag:"):]
+		return func(point *timeseries.Point) string { return point.Tags[tag] }, nil
+	case strings.HasPrefix(key, "subject:"):
+		n, err := strconv.Atoi(key[len("subject:"):])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid key %q, the subject token must be a number from 1", key)
+		}
+		return func(point *timeseries.Point) string {
+			tokens := strings.Split(point.Source, ".")
+			if n > len(tokens) {
+				return ""
+			}
+			return tokens[n-1]
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid key %q, must be one of source, subject:N, tag:KEY or producer", key)
+}
+
+func parseBucketLimit(rate, burst string) (bucketLimit, error) {
+	var limit bucketLimit
+	if rate == "" {
+		return limit, errors.New("missing rate")
+	}
+	var err error
+	if limit.rate, err = strconv.ParseFloat(rate, 64); err != nil || limit.rate <= 0 {
+		return limit, fmt.Errorf("invalid rate %q, must be a positive number of points per second", rate)
+	}
+	limit.burst = limit.rate
+	if burst != "" {
+		if limit.burst, err = strconv.ParseFloat(burst, 64); err != nil || limit.burst <= 0 {
+			return limit, fmt.Errorf("invalid burst %q, must be a positive number of points", burst)
+		}
+	}
+	// a burst under a point would throttle everything
+	if limit.burst < 1 {
+		limit.burst = 1
+	}
+	return limit, nil
+}
+
+func (rl *rateLimit) Process(point *timeseries.Point) *timeseries.Point {
+	key := rl.key(point)
+	if key == "" {
+		return point
+	}
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.clean(now)
+	b, ok := rl.buckets[key]
+	if !ok {
+		limit, ok := rl.overrides[key]
+		if !ok {
+			limit = rl.limit
+		}
+		b = &bucket{limit: limit, tokens: limit.burst, last: now}
+		rl.buckets[key] = b
+	}
+	if b.take(now) {
+		return point
+	}
+	if b.throttled == nil {
+		log.Printf("Producer %s exceeds its rate limit of %g points per second, throttling it.", key, b.limit.rate)
+		b.throttled = instrument.Default.Counter("metricas_ratelimit", rl.tags(key), "points_throttled")
+	}
+	b.throttled.Inc()
+	return nil
+}
+
+func (rl *rateLimit) tags(key string) map[string]string {
+	return map[string]string{"limiter": rl.name, "key": key}
+}
+
+// Forgets buckets unused long enough to be full again, along with their
+// counters, so that producers going away do not leak them
+func (rl *rateLimit) clean(now time.Time) {
+	if now.Sub(rl.cleaned) < RATELIMIT_IDLE_MS*time.Millisecond {
+		return
+	}
+	for key, b := range rl.buckets {
+		if now.Sub(b.last).Seconds()*b.limit.rate+b.tokens >= b.limit.burst {
+			delete(rl.buckets, key)
+			if b.throttled != nil {
+				instrument.Default.Unregister("metricas_ratelimit", rl.tags(key))
+			}
+		}
+	}
+	rl.cleaned = now
+}
+
+// Refills the bucket for the time elapsed, then takes a token if there is one
+func (b *bucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.rate
+	if b.tokens > b.limit.burst {
+		b.tokens = b.limit.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,160 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/timeseries"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Unix(1434055562, 0)
+	tests := []struct {
+		name  string
+		limit bucketLimit
+		takes []time.Duration // since start
+		want  []bool
+	}{
+		{"burst", bucketLimit{rate: 1, burst: 3}, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refilled at rate", bucketLimit{rate: 10, burst: 1}, []time.Duration{0, 50 * time.Millisecond, 100 * time.Millisecond, 150 * time.Millisecond}, []bool{true, false, true, false}},
+		{"refilled up to burst", bucketLimit{rate: 10, burst: 2}, []time.Duration{0, 0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, true, false}},
+		{"fractional rate", bucketLimit{rate: 0.5, burst: 1}, []time.Duration{0, time.Second, 2 * time.Second}, []bool{true, false, true}},
+	}
+	for _, test := range tests {
+		b := &bucket{limit: test.limit, tokens: test.limit.burst, last: start}
+		for i, d := range test.takes {
+			if got := b.take(start.Add(d)); got != test.want[i] {
+				t.Errorf("%s: take %d at %s got %t, want %t", test.name, i, d, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestParseBucketLimit(t *testing.T) {
+	tests := []struct {
+		rate, burst string
+		want        bucketLimit
+		valid       bool
+	}{
+		{"10", "", bucketLimit{rate: 10, burst: 10}, true},
+		{"10", "50", bucketLimit{rate: 10, burst: 50}, true},
+		{"0.1", "", bucketLimit{rate: 0.1, burst: 1}, true},
+		{"", "", bucketLimit{}, false},
+		{"0", "", bucketLimit{}, false},
+		{"10", "-1", bucketLimit{}, false},
+		{"fast", "", bucketLimit{}, false},
+	}
+	for _, test := range tests {
+		limit, err := parseBucketLimit(test.rate, test.burst)
+		if (err == nil) != test.valid {
+			t.Errorf("rate %q, burst %q: got error %v, want valid %t", test.rate, test.burst, err, test.valid)
+			continue
+		}
+		if test.valid && limit != test.want {
+			t.Errorf("rate %q, burst %q: got %+v, want %+v", test.rate, test.burst, limit, test.want)
+		}
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	point := &timeseries.Point{
+		Measurement: "cpu",
+		Tags:        map[string]string{"host": "a"},
+		Source:      "metrics.eu.a",
+		Producer:    "p1",
+	}
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"", "metrics.eu.a"},
+		{"source", "metrics.eu.a"},
+		{"producer", "p1"},
+		{"tag:host", "a"},
+		{"tag:region", ""},
+		{"subject:2", "eu"},
+		{"subject:4", ""},
+	}
+	for _, test := range tests {
+		key, err := rateLimitKey(test.key)
+		if err != nil {
+			t.Errorf("key %q: %s", test.key, err)
+			continue
+		}
+		if got := key(point); got != test.want {
+			t.Errorf("key %q: got %q, want %q", test.key, got, test.want)
+		}
+	}
+	for _, invalid := range []string{"tag:", "subject:0", "subject:x", "host"} {
+		if _, err := rateLimitKey(invalid); err == nil {
+			t.Errorf("key %q: got no error", invalid)
+		}
+	}
+}
+
+func TestRateLimitOverrides(t *testing.T) {
+	p, err := NewRateLimit(&Configuration{
+		Name:    "ratelimit_test",
+		Options: map[string]string{"key": "tag:host", "rate": "1", "overrides": "big=1:3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		kept int
+	}{
+		{"small", 1},
+		{"big", 3},
+		{"", 5}, // not limited without identity
+	}
+	for _, test := range tests {
+		// the counter outlives the processor, e.g. when tests run again
+		tags := map[string]string{"limiter": "ratelimit_test", "key": test.host}
+		throttled := instrument.Default.Counter("metricas_ratelimit", tags, "points_throttled")
+		before := throttled.Value()
+		var kept int
+		for i := 0; i < 5; i++ {
+			if p.Process(&timeseries.Point{Measurement: "cpu", Tags: map[string]string{"host": test.host}}) != nil {
+				kept++
+			}
+		}
+		if kept != test.kept {
+			t.Errorf("host %q: kept %d of 5 points, want %d", test.host, kept, test.kept)
+		}
+		if n := throttled.Value() - before; n != uint64(5-test.kept) {
+			t.Errorf("host %q: %d points throttled, want %d", test.host, n, 5-test.kept)
+		}
+	}
+}
+
+func TestRateLimitClean(t *testing.T) {
+	rl := &rateLimit{
+		name:    "ratelimit_clean_test",
+		key:     func(point *timeseries.Point) string { return point.Source },
+		limit:   bucketLimit{rate: 1, burst: 1},
+		buckets: make(map[string]*bucket),
+	}
+	now := time.Now()
+	rl.cleaned = now
+	for _, source := range []string{"idle", "busy"} {
+		rl.Process(&timeseries.Point{Source: source})
+		rl.Process(&timeseries.Point{Source: source})
+	}
+	// busy keeps on draining its bucket, idle refills and is forgotten
+	later := now.Add(RATELIMIT_IDLE_MS * time.Millisecond)
+	rl.buckets["busy"].last, rl.buckets["busy"].tokens = later, 0
+	rl.clean(later)
+	if _, ok := rl.buckets["idle"]; ok {
+		t.Error("idle bucket kept")
+	}
+	if _, ok := rl.buckets["busy"]; !ok {
+		t.Error("busy bucket forgotten")
+	}
+	for _, m := range instrument.Default.Snapshot() {
+		if m.Name == "metricas_ratelimit" && m.Tags["limiter"] == rl.name && m.Tags["key"] == "idle" {
+			t.Error("throttled counter of the idle bucket kept")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	PROCESSOR_TAGS = "tags"
+)
+
+func init() {
+	RegisterProcessor(PROCESSOR_TAGS, NewTags)
+}
+
+// Adds and removes tags. Options:
+//
+//	add   comma-separated key=value pairs, set on every point
+//	drop  comma-separated keys, removed from every point
+type tags struct {
+	add  map[string]string
+	drop []string
+}
+
+func NewTags(config *Configuration) (Processor, error) {
+	t := &tags{
+		add:  make(map[string]string),
+		drop: splitList(config.Options["drop"]),
+	}
+	for _, pair := range splitList(config.Options["add"]) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		t.add[kv[0]] = kv[1]
+	}
+	for k := range config.Options {
+		if k != "add" && k != "drop" {
+			return nil, fmt.Errorf("unknown option %q", k)
+		}
+	}
+	return t, nil
+}
+
+func (t *tags) Process(point *timeseries.Point) *timeseries.Point {
+	// points may be shared, so tags are modified on a copy
+	p := *point
+	p.Tags = make(map[string]string, len(point.Tags)+len(t.add))
+	for k, v := range point.Tags {
+		p.Tags[k] = v
+	}
+	for k, v := range t.add {
+		p.Tags[k] = v
+	}
+	for _, k := range t.drop {
+		delete(p.Tags, k)
+	}
+	return &p
+}
@@ -0,0 +1,167 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	PROCESSOR_TIMESTAMPS = "timestamps"
+
+	TIMESTAMPS_KEEP    = "keep"    // leave points without time to be timestamped by InfluxDB
+	TIMESTAMPS_RECEIVE = "receive" // timestamp points without time with the time they were received
+	TIMESTAMPS_CLAMP   = "clamp"   // move points from the future back to the tolerance
+	TIMESTAMPS_DROP    = "drop"    // drop points
+)
+
+func init() {
+	RegisterProcessor(PROCESSOR_TIMESTAMPS, NewTimestamps)
+}
+
+// Applies policies to the time of points, compared to when they were
+// received. Options:
+//
+//	missing        what happens to points without time, keep (default),
+//	               receive or drop
+//	future         how far ahead of the time they were received points may
+//	               be, unlimited by default
+//	future_action  what happens to points further ahead, clamp (default),
+//	               moving them back to the tolerance, or drop
+//	late           how far behind the time they were received points may be,
+//	               unlimited by default
+//	backfill_rp    retention policy points further behind are written to,
+//	               they are dropped otherwise
+//
+// The difference between the time of points and when they were received, the
+// clock skew of their producers plus latency, is measured by source as the
+// skew_ms histogram of metricas_timestamps, along with counts of the points
+// each policy applied to.
+type timestamps struct {
+	missing      string
+	future       time.Duration
+	futureAction string
+	late         time.Duration
+	backfillRp   string
+
+	mu      sync.Mutex
+	sources map[string]*timestampsStats
+}
+
+type timestampsStats struct {
+	skew        *instrument.Histogram
+	timestamped *instrument.Counter
+	clamped     *instrument.Counter
+	backfilled  *instrument.Counter
+	dropped     *instrument.Counter
+}
+
+func NewTimestamps(config *Configuration) (Processor, error) {
+	t := &timestamps{
+		missing:      TIMESTAMPS_KEEP,
+		futureAction: TIMESTAMPS_CLAMP,
+		sources:      make(map[string]*timestampsStats),
+	}
+	for k, v := range config.Options {
+		var err error
+		switch k {
+		case "missing":
+			t.missing = v
+			if v != TIMESTAMPS_KEEP && v != TIMESTAMPS_RECEIVE && v != TIMESTAMPS_DROP {
+				err = errors.New("must be one of keep, receive or drop")
+			}
+		case "future":
+			t.future, err = time.ParseDuration(v)
+		case "future_action":
+			t.futureAction = v
+			if v != TIMESTAMPS_CLAMP && v != TIMESTAMPS_DROP {
+				err = errors.New("must be one of clamp or drop")
+			}
+		case "late":
+			t.late, err = time.ParseDuration(v)
+		case "backfill_rp":
+			t.backfillRp = v
+		default:
+			return nil, fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %s", k, v, err)
+		}
+	}
+	if t.future < 0 || t.late < 0 {
+		return nil, errors.New("future and late must not be negative")
+	}
+	if t.backfillRp != "" && t.late == 0 {
+		return nil, errors.New("backfill_rp requires late")
+	}
+	return t, nil
+}
+
+func (t *timestamps) Process(point *timeseries.Point) *timeseries.Point {
+	received := point.Received
+	if received.IsZero() {
+		received = time.Now()
+	}
+	stats := t.stats(point.Source)
+
+	if point.Time.IsZero() {
+		switch t.missing {
+		case TIMESTAMPS_RECEIVE:
+			p := *point
+			p.Time = received
+			stats.timestamped.Inc()
+			return &p
+		case TIMESTAMPS_DROP:
+			stats.dropped.Inc()
+			return nil
+		}
+		return point
+	}
+
+	skew := point.Time.Sub(received)
+	stats.skew.Observe(float64(skew) / float64(time.Millisecond))
+	if t.future > 0 && skew > t.future {
+		if t.futureAction == TIMESTAMPS_DROP {
+			stats.dropped.Inc()
+			return nil
+		}
+		p := *point
+		p.Time = received.Add(t.future)
+		stats.clamped.Inc()
+		return &p
+	}
+	if t.late > 0 && -skew > t.late {
+		if t.backfillRp == "" {
+			stats.dropped.Inc()
+			return nil
+		}
+		p := *point
+		p.RetentionPolicy = t.backfillRp
+		stats.backfilled.Inc()
+		return &p
+	}
+	return point
+}
+
+// Returns the instrumentation of the given source, creating it if needed
+func (t *timestamps) stats(source string) *timestampsStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats, ok := t.sources[source]
+	if !ok {
+		tags := map[string]string{"source": source}
+		stats = &timestampsStats{
+			skew:        instrument.Default.Histogram("metricas_timestamps", tags, "skew_ms"),
+			timestamped: instrument.Default.Counter("metricas_timestamps", tags, "points_timestamped"),
+			clamped:     instrument.Default.Counter("metricas_timestamps", tags, "points_clamped"),
+			backfilled:  instrument.Default.Counter("metricas_timestamps", tags, "points_backfilled"),
+			dropped:     instrument.Default.Counter("metricas_timestamps", tags, "points_dropped"),
+		}
+		t.sources[source] = stats
+	}
+	return stats
+}
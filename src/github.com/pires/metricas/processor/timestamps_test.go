@@ -0,0 +1,73 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+func TestTimestamps(t *testing.T) {
+	received := time.Unix(1434055562, 0)
+	tests := []struct {
+		name    string
+		options map[string]string
+		time    time.Time // of the point
+		want    time.Time // once processed
+		rp      string
+		dropped bool
+	}{
+		{"missing kept", nil, time.Time{}, time.Time{}, "", false},
+		{"missing received", map[string]string{"missing": "receive"}, time.Time{}, received, "", false},
+		{"missing dropped", map[string]string{"missing": "drop"}, time.Time{}, time.Time{}, "", true},
+		{"future unlimited", nil, received.Add(time.Hour), received.Add(time.Hour), "", false},
+		{"future within tolerance", map[string]string{"future": "1m"}, received.Add(time.Minute), received.Add(time.Minute), "", false},
+		{"future clamped", map[string]string{"future": "1m"}, received.Add(time.Hour), received.Add(time.Minute), "", false},
+		{"future dropped", map[string]string{"future": "1m", "future_action": "drop"}, received.Add(time.Hour), time.Time{}, "", true},
+		{"late unlimited", nil, received.Add(-time.Hour), received.Add(-time.Hour), "", false},
+		{"late within tolerance", map[string]string{"late": "1h"}, received.Add(-time.Hour), received.Add(-time.Hour), "", false},
+		{"late dropped", map[string]string{"late": "1h"}, received.Add(-2 * time.Hour), time.Time{}, "", true},
+		{"late backfilled", map[string]string{"late": "1h", "backfill_rp": "backfill"}, received.Add(-2 * time.Hour), received.Add(-2 * time.Hour), "backfill", false},
+	}
+	for _, test := range tests {
+		p, err := NewTimestamps(&Configuration{Options: test.options})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		point := &timeseries.Point{Measurement: "cpu", Time: test.time, Received: received, Source: "timestamps_test"}
+		got := p.Process(point)
+		switch dropped := test.dropped; {
+		case dropped && got != nil:
+			t.Errorf("%s: point kept at %s, want dropped", test.name, got.Time)
+		case !dropped && got == nil:
+			t.Errorf("%s: point dropped, want kept at %s", test.name, test.want)
+		case !dropped && !got.Time.Equal(test.want):
+			t.Errorf("%s: point kept at %s, want %s", test.name, got.Time, test.want)
+		case !dropped && got.RetentionPolicy != test.rp:
+			t.Errorf("%s: point written to retention policy %q, want %q", test.name, got.RetentionPolicy, test.rp)
+		case !dropped && got != point && !point.Time.Equal(test.time):
+			t.Errorf("%s: original point changed", test.name)
+		}
+	}
+}
+
+func TestTimestampsOptions(t *testing.T) {
+	tests := []struct {
+		options map[string]string
+		valid   bool
+	}{
+		{map[string]string{}, true},
+		{map[string]string{"missing": "receive", "future": "1m", "future_action": "drop", "late": "1h", "backfill_rp": "old"}, true},
+		{map[string]string{"missing": "clamp"}, false},
+		{map[string]string{"future_action": "receive"}, false},
+		{map[string]string{"future": "-1m"}, false},
+		{map[string]string{"late": "soon"}, false},
+		{map[string]string{"backfill_rp": "old"}, false},
+		{map[string]string{"skew": "1m"}, false},
+	}
+	for _, test := range tests {
+		if _, err := NewTimestamps(&Configuration{Options: test.options}); (err == nil) != test.valid {
+			t.Errorf("%v: got error %v, want valid %t", test.options, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats"
+
+	"github.com/pires/metricas/instrument"
+)
+
+// How to connect to NATS
+type NATSConfiguration struct {
+	// servers of the NATS cluster, as host:port or nats:// URLs
+	Servers []string
+	// credentials, unless given in the server URLs, either a user and
+	// password or a token
+	User     string
+	Password string
+	Token    string
+	// connects over TLS, verifying the server certificate against CACert, a
+	// PEM file, or the system CAs, unless InsecureSkipVerify, and presenting
+	// the client certificate and key of Cert and Key, PEM files, if any
+	Secure             bool
+	CACert             string
+	Cert               string
+	Key                string
+	InsecureSkipVerify bool
+	// client name, as shown by the NATS server monitoring
+	Name string
+	// time to wait before reconnecting to a server, defaults to
+	// nats.DefaultReconnectWait
+	ReconnectWait time.Duration
+	// attempts to reconnect to every server before giving up, defaults to
+	// nats.DefaultMaxReconnect, never giving up when negative
+	MaxReconnect int
+	// how often the server is pinged to detect broken connections, defaults
+	// to nats.DefaultPingInterval
+	PingInterval time.Duration
+	// to connect to a server, defaults to nats.DefaultTimeout
+	Timeout time.Duration
+}
+
+// Checks server URLs and fills in defaults for settings left empty
+func (config *NATSConfiguration) validate() error {
+	if len(config.Servers) == 0 {
+		return errors.New("missing NATS servers")
+	}
+	for _, server := range config.Servers {
+		if _, err := config.serverURL(server); err != nil {
+			return fmt.Errorf("invalid server %q: %s", server, err)
+		}
+	}
+	if config.User != "" && config.Token != "" {
+		return errors.New("either a NATS user or a token must be given, not both")
+	}
+	if !config.Secure && (config.CACert != "" || config.Cert != "" || config.Key != "" || config.InsecureSkipVerify) {
+		return errors.New("NATS certificates and skipping verification require TLS")
+	}
+	if _, err := config.tlsConfig(); err != nil {
+		return err
+	}
+	if config.ReconnectWait <= 0 {
+		config.ReconnectWait = nats.DefaultReconnectWait
+	}
+	if config.MaxReconnect == 0 {
+		config.MaxReconnect = nats.DefaultMaxReconnect
+	}
+	if config.PingInterval <= 0 {
+		config.PingInterval = nats.DefaultPingInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = nats.DefaultTimeout
+	}
+	return nil
+}
+
+// Returns the URL of a server, with credentials
+func (config *NATSConfiguration) serverURL(server string) (*url.URL, error) {
+	if !strings.Contains(server, "://") {
+		server = "nats://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+	if u.User == nil && config.User != "" {
+		u.User = url.UserPassword(config.User, config.Password)
+	}
+	return u, nil
+}
+
+// Returns the TLS configuration of secure connections, nil otherwise
+func (config *NATSConfiguration) tlsConfig() (*tls.Config, error) {
+	if !config.Secure {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CACert != "" {
+		pem, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACert)
+		}
+	}
+	if config.Cert != "" || config.Key != "" {
+		if config.Cert == "" || config.Key == "" {
+			return nil, errors.New("NATS client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Server addresses, without credentials, for logs
+func (config *NATSConfiguration) String() string {
+	hosts := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		if u, err := config.serverURL(server); err == nil {
+			hosts = append(hosts, u.Host)
+		}
+	}
+	return strings.Join(hosts, ",")
+}
+
+// Connects to NATS, keeping track of the connection state for readiness. The
+// embedded NATS server, if any, must have been started.
+func (svc *MetricsService) connect() (*nats.Conn, error) {
+	config := svc.config.NATS
+	opts := nats.DefaultOptions
+	for _, server := range config.Servers {
+		u, _ := config.serverURL(server) // validated already
+		opts.Servers = append(opts.Servers, u.String())
+	}
+	opts.Secure = config.Secure
+	opts.TLSConfig, _ = config.tlsConfig() // validated already
+	opts.Token = config.Token
+	opts.Name = config.Name
+	opts.ReconnectWait = config.ReconnectWait
+	opts.MaxReconnect = config.MaxReconnect
+	opts.PingInterval = config.PingInterval
+	opts.Timeout = config.Timeout
+	opts.AsyncErrorCB = svc.handleNatsError
+	opts.DisconnectedCB = svc.handleDisconnected
+	opts.ReconnectedCB = svc.handleReconnected
+	opts.ClosedCB = svc.handleClosed
+	svc.reconnects = instrument.Default.Counter("metricas_nats", nil, "reconnects")
+	nc, err := opts.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to NATS %s: %s", config, err)
+	}
+
+	instrument.Default.Gauge("metricas_nats", nil, "connected", func() int64 {
+		if nc.Status() == nats.CONNECTED {
+			return 1
+		}
+		return 0
+	})
+	return nc, nil
+}
+
+// Closes the connection to NATS
+func (svc *MetricsService) disconnect() {
+	atomic.StoreInt32(&svc.natsClosed, 1)
+	svc.nc.Close()
+}
+
+// Shuts the embedded NATS server down, if any
+func (svc *MetricsService) stopNATSServer() {
+	if svc.natsServer != nil {
+		svc.natsServer.Shutdown()
+	}
+}
+
+// Checks the service is connected to NATS
+func (svc *MetricsService) natsReady() error {
+	switch svc.nc.Status() {
+	case nats.CONNECTED:
+		return nil
+	case nats.CLOSED:
+		return fmt.Errorf("connection to NATS %s closed", svc.config.NATS)
+	}
+	since := time.Unix(0, atomic.LoadInt64(&svc.disconnectedAt))
+	return fmt.Errorf("disconnected from NATS %s for %s, reconnecting", svc.config.NATS, time.Since(since))
+}
+
+// The NATS client may report the same disconnection more than once, e.g. when
+// closing the connection after failing to reconnect
+func (svc *MetricsService) handleDisconnected(nc *nats.Conn) {
+	if atomic.CompareAndSwapInt64(&svc.disconnectedAt, 0, time.Now().UnixNano()) && !svc.stopped() {
+		log.Printf("Disconnected from NATS %s, reconnecting...", svc.config.NATS)
+	}
+}
+
+func (svc *MetricsService) handleReconnected(nc *nats.Conn) {
+	since := time.Unix(0, atomic.SwapInt64(&svc.disconnectedAt, 0))
+	svc.reconnects.Inc()
+	log.Printf("Reconnected to NATS, after %s.", time.Since(since))
+}
+
+// Called once the connection is closed for good, when stopping or after
+// failing to reconnect
+func (svc *MetricsService) handleClosed(nc *nats.Conn) {
+	if atomic.CompareAndSwapInt32(&svc.natsClosed, 0, 1) && !svc.stopped() {
+		svc.reportError(fmt.Errorf("gave up reconnecting to NATS %s, no metrics will be received from it", svc.config.NATS))
+	}
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+const (
+	OVERFLOW_BLOCK       = "block"       // wait for room, eventually making NATS drop messages
+	OVERFLOW_DROP_NEWEST = "drop-newest" // discard incoming points
+	OVERFLOW_DROP_OLDEST = "drop-oldest" // discard the oldest queued points
+	OVERFLOW_SAMPLE      = "sample"      // keep one in SampleRate points once half full
+
+	QUEUE_SIZE        = 16384 // points queued between NATS and the sink
+	QUEUE_SAMPLE_RATE = 10    // keep one in 10 points when sampling
+)
+
+type QueueConfiguration struct {
+	// defaults to QUEUE_SIZE
+	Size int
+	// what happens to points once the queue is full, defaults to OVERFLOW_BLOCK
+	OverflowPolicy string
+	// for OVERFLOW_SAMPLE, defaults to QUEUE_SAMPLE_RATE
+	SampleRate int
+}
+
+type QueueStats struct {
+	Depth    int    // points queued
+	Capacity int    // points that can be queued
+	Dropped  uint64 // points discarded by the overflow policy
+}
+
+// Bounded queue of points waiting to be written, applying the overflow policy
+// when points come in faster than they are written
+type queue struct {
+	points     chan *timeseries.Point
+	policy     string
+	sampleRate uint64
+	// updated atomically
+	dropped uint64
+	sampled uint64
+}
+
+// Checks the overflow policy and fills in defaults for settings left empty
+func (config *QueueConfiguration) validate() error {
+	if config.Size <= 0 {
+		config.Size = QUEUE_SIZE
+	}
+	switch config.OverflowPolicy {
+	case "":
+		config.OverflowPolicy = OVERFLOW_BLOCK
+	case OVERFLOW_BLOCK, OVERFLOW_DROP_NEWEST, OVERFLOW_DROP_OLDEST, OVERFLOW_SAMPLE:
+	default:
+		return fmt.Errorf("invalid overflow policy %q, must be one of block, drop-newest, drop-oldest or sample", config.OverflowPolicy)
+	}
+	if config.SampleRate <= 0 {
+		config.SampleRate = QUEUE_SAMPLE_RATE
+	}
+	return nil
+}
+
+// Creates a queue out of a validated configuration
+func newQueue(config *QueueConfiguration) *queue {
+	return &queue{
+		points:     make(chan *timeseries.Point, config.Size),
+		policy:     config.OverflowPolicy,
+		sampleRate: uint64(config.SampleRate),
+	}
+}
+
+func (q *queue) push(point *timeseries.Point) {
+	switch q.policy {
+	case OVERFLOW_BLOCK:
+		q.points <- point
+	case OVERFLOW_DROP_OLDEST:
+		for {
+			select {
+			case q.points <- point:
+				return
+			default:
+			}
+			// make room, unless the consumer just did
+			select {
+			case <-q.points:
+				atomic.AddUint64(&q.dropped, 1)
+			default:
+			}
+		}
+	case OVERFLOW_SAMPLE:
+		if len(q.points) >= cap(q.points)/2 && atomic.AddUint64(&q.sampled, 1)%q.sampleRate != 0 {
+			atomic.AddUint64(&q.dropped, 1)
+			return
+		}
+		fallthrough
+	case OVERFLOW_DROP_NEWEST:
+		select {
+		case q.points <- point:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+	}
+}
+
+func (q *queue) stats() QueueStats {
+	return QueueStats{
+		Depth:    len(q.points),
+		Capacity: cap(q.points),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+	}
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pires/metricas/timeseries"
+)
+
+func TestQueueOverflow(t *testing.T) {
+	tests := []struct {
+		policy  string
+		kept    []int64
+		dropped uint64
+	}{
+		{OVERFLOW_DROP_NEWEST, []int64{0, 1, 2, 3}, 6},
+		{OVERFLOW_DROP_OLDEST, []int64{6, 7, 8, 9}, 6},
+		// one in two points once half full, until full
+		{OVERFLOW_SAMPLE, []int64{0, 1, 3, 5}, 6},
+	}
+	for _, test := range tests {
+		config := &QueueConfiguration{Size: 4, OverflowPolicy: test.policy, SampleRate: 2}
+		if err := config.validate(); err != nil {
+			t.Fatal(err)
+		}
+		q := newQueue(config)
+		for i := int64(0); i < 10; i++ {
+			q.push(&timeseries.Point{Measurement: "cpu", Fields: map[string]interface{}{"seq": i}})
+		}
+		stats := q.stats()
+		if stats.Dropped != test.dropped {
+			t.Errorf("%s: %d points dropped, want %d", test.policy, stats.Dropped, test.dropped)
+		}
+		var kept []int64
+		for len(q.points) > 0 {
+			kept = append(kept, (<-q.points).Fields["seq"].(int64))
+		}
+		if !reflect.DeepEqual(kept, test.kept) {
+			t.Errorf("%s: kept points %v, want %v", test.policy, kept, test.kept)
+		}
+	}
+}
+
+func TestQueueOverflowBlock(t *testing.T) {
+	config := &QueueConfiguration{Size: 1}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	q := newQueue(config)
+	q.push(&timeseries.Point{Measurement: "first"})
+	pushed := make(chan struct{})
+	go func() {
+		q.push(&timeseries.Point{Measurement: "second"})
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("pushed to a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if p := <-q.points; p.Measurement != "first" {
+		t.Errorf("got %s, want first", p.Measurement)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("still blocked once there is room")
+	}
+	if p := <-q.points; p.Measurement != "second" {
+		t.Errorf("got %s, want second", p.Measurement)
+	}
+	if dropped := q.stats().Dropped; dropped != 0 {
+		t.Errorf("%d points dropped, want 0", dropped)
+	}
+}
+
+func TestQueueConfigurationDefaults(t *testing.T) {
+	tests := []struct {
+		config QueueConfiguration
+		want   QueueConfiguration
+		valid  bool
+	}{
+		{QueueConfiguration{}, QueueConfiguration{QUEUE_SIZE, OVERFLOW_BLOCK, QUEUE_SAMPLE_RATE}, true},
+		{QueueConfiguration{8, OVERFLOW_SAMPLE, 3}, QueueConfiguration{8, OVERFLOW_SAMPLE, 3}, true},
+		{QueueConfiguration{-1, OVERFLOW_DROP_OLDEST, -1}, QueueConfiguration{QUEUE_SIZE, OVERFLOW_DROP_OLDEST, QUEUE_SAMPLE_RATE}, true},
+		{QueueConfiguration{OverflowPolicy: "drop"}, QueueConfiguration{}, false},
+	}
+	for _, test := range tests {
+		config := test.config
+		err := config.validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: got error %v, want valid %t", test.config, err, test.valid)
+			continue
+		}
+		if test.valid && config != test.want {
+			t.Errorf("%+v: got %+v, want %+v", test.config, config, test.want)
+		}
+	}
+}
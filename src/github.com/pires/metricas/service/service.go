@@ -1,76 +1,862 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	influxdb "github.com/influxdb/influxdb/client"
+	"github.com/golang/protobuf/proto"
 	"github.com/nats-io/nats"
-	"github.com/nats-io/nats/encoders/protobuf"
 
 	"github.com/pires/metricas/api"
+	"github.com/pires/metricas/input"
+	"github.com/pires/metricas/instrument"
+	"github.com/pires/metricas/natsserver"
+	"github.com/pires/metricas/pipeline"
+	"github.com/pires/metricas/processor"
 	"github.com/pires/metricas/timeseries"
 )
 
 const (
-	SUBJECT = "metrics"
+	SUBJECT         = "metrics"
+	INTERNAL_SOURCE = "metricas" // source of internal measurements, for routing
+
+	REPORT_INTERVAL_MS  = 10000 // report overload every 10 seconds
+	SHUTDOWN_TIMEOUT_MS = 30000 // give up draining after 30 seconds
+	ERRORS_BUFFER       = 64    // errors kept until read from Errors()
+	READY_QUEUE_RATIO   = 0.9   // not ready once the queue is 90% full
+	READY_TIMEOUT_MS    = 2000  // not ready if the sink does not answer a ping in 2 seconds
+)
+
+var (
+	ErrShutdownTimeout = errors.New("shutdown timed out")
+	ErrAlreadyStarted  = errors.New("service already started")
+	ErrNotStarted      = errors.New("service not started")
+	ErrStopped         = errors.New("service stopped")
+	ErrCannotPause     = errors.New("sink cannot be paused")
 )
 
 type Configuration struct {
-	AddrNats         string // host:port
-	TimeSeriesConfig *timeseries.Configuration
+	AddrNats string // host:port of a single NATS server, see NATS otherwise
+	NATS     *NATSConfiguration
+	// runs a NATS server in-process, consuming metrics from it instead
+	EmbeddedNATS *natsserver.Configuration
+	// subjects to consume metrics from, defaults to SUBJECT
+	Subjects []string
+	// other inputs points are received from
+	Inputs []*input.Configuration
+	Queue  *QueueConfiguration
+	// run on every point before it is written, in order
+	Processors []*processor.Configuration
+	// where points are written to, either a sink or a pipeline routing them to
+	// several
+	Sink     *timeseries.SinkConfiguration
+	Pipeline *pipeline.Configuration
+	// time allowed to drain and flush points on shutdown, defaults to
+	// SHUTDOWN_TIMEOUT_MS
+	ShutdownTimeout time.Duration
+	// how often internal measurements of instrument.Default are written to
+	// the sink, never when zero
+	InstrumentInterval time.Duration
+	// the service is not ready once the queue is fuller than this ratio of its
+	// capacity, defaults to READY_QUEUE_RATIO
+	ReadyQueueRatio float64
 }
 
-type metricsService struct {
+type Stats struct {
+	Received     uint64 // NATS messages handled
+	Invalid      uint64 // NATS messages that were not valid metrics
+	SlowConsumer uint64 // times NATS dropped messages not consumed fast enough
+	Paused       bool   // whether writes to the sink are paused
+	Queue        QueueStats
+	Sink         timeseries.Stats
+	// statistics by backend, for sinks writing to several
+	Backends map[string]timeseries.Stats
+}
+
+// Consumes metrics from NATS and writes them to the configured sink
+type MetricsService struct {
 	config     *Configuration
-	metricChan chan *api.Metric
-	quit       chan struct{}
+	queue      *queue
+	mu         sync.Mutex // guards sink and processors, replaced on reload
+	sink       timeseries.Sink
+	processors processor.Chain
+	inputs     []input.Input
+	nc         *nats.Conn
+	natsServer *natsserver.Server // embedded, if any
+	subsMu     sync.Mutex
+	subs       map[string]*subscription
+	reloadMu   sync.Mutex
+	// channels
+	errs     chan error
+	synced   chan chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	drain    chan struct{}
+	closed   chan error
+	done     chan struct{}
+	result   error // set before done is closed
+	// updated atomically
+	started        int32
+	paused         int32
+	disconnectedAt int64 // Unix nanoseconds, 0 while connected to NATS
+	natsClosed     int32
+	received       uint64
+	invalid        uint64
+	slowConsumer   uint64
+	// instrumentation
+	reconnects *instrument.Counter
+}
+
+type subscription struct {
+	*nats.Subscription
+	handled uint64 // messages handled, updated atomically
 }
 
-func NewMetricsService(config *Configuration) (chan struct{}, error) {
-	svc := &metricsService{
-		metricChan: make(chan *api.Metric),
-		quit:       make(chan struct{}, 1),
+func NewMetricsService(config *Configuration) (*MetricsService, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
+	return &MetricsService{
+		config: config,
+		queue:  newQueue(config.Queue),
+		subs:   make(map[string]*subscription),
+		errs:   make(chan error, ERRORS_BUFFER),
+		synced: make(chan chan struct{}),
+		stop:   make(chan struct{}),
+		drain:  make(chan struct{}),
+		closed: make(chan error, 1),
+		done:   make(chan struct{}),
+	}, nil
+}
 
-	ts, err := timeseries.NewTimeSeries(config.TimeSeriesConfig)
+// Checks the configuration, filling in defaults, without connecting to NATS or
+// the sink
+func (config *Configuration) Validate() error {
+	if config.NATS == nil {
+		config.NATS = &NATSConfiguration{}
+	}
+	if len(config.NATS.Servers) == 0 && config.AddrNats != "" {
+		config.NATS.Servers = []string{config.AddrNats}
+	}
+	if config.EmbeddedNATS != nil {
+		if err := config.EmbeddedNATS.Validate(); err != nil {
+			return err
+		}
+		config.NATS.Servers = []string{config.EmbeddedNATS.ClientAddr()}
+		config.NATS.User = config.EmbeddedNATS.User
+		config.NATS.Password = config.EmbeddedNATS.Password
+		// the embedded server authenticates with neither tokens nor TLS
+		config.NATS.Token = ""
+		config.NATS.Secure, config.NATS.InsecureSkipVerify = false, false
+		config.NATS.CACert, config.NATS.Cert, config.NATS.Key = "", "", ""
+	}
+	if err := config.NATS.validate(); err != nil {
+		return err
+	}
+	if len(config.Subjects) == 0 {
+		config.Subjects = []string{SUBJECT}
+	}
+	if config.Queue == nil {
+		config.Queue = &QueueConfiguration{}
+	}
+	if err := config.Queue.validate(); err != nil {
+		return fmt.Errorf("queue: %s", err)
+	}
+	names := make(map[string]bool, len(config.Inputs))
+	for _, inputConfig := range config.Inputs {
+		if inputConfig.Name == "" {
+			inputConfig.Name = inputConfig.Type
+		}
+		if names[inputConfig.Name] {
+			return fmt.Errorf("input %s defined twice", inputConfig.Name)
+		}
+		names[inputConfig.Name] = true
+		if _, err := input.NewInput(inputConfig); err != nil {
+			return fmt.Errorf("input %s: %s", inputConfig.Name, err)
+		}
+	}
+	if _, err := processor.NewChain(config.Processors); err != nil {
+		return err
+	}
+	switch {
+	case config.Sink != nil && config.Pipeline != nil:
+		return errors.New("either a sink or a pipeline must be configured, not both")
+	case config.Pipeline != nil:
+		if err := config.Pipeline.Validate(); err != nil {
+			return fmt.Errorf("pipeline: %s", err)
+		}
+	case config.Sink != nil:
+		if err := config.Sink.Validate(); err != nil {
+			return fmt.Errorf("%s sink: %s", config.Sink.Type, err)
+		}
+	default:
+		return errors.New("missing sink configuration")
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = SHUTDOWN_TIMEOUT_MS * time.Millisecond
+	}
+	if config.ReadyQueueRatio <= 0 {
+		config.ReadyQueueRatio = READY_QUEUE_RATIO
+	}
+	return nil
+}
 
-	// start NATS client
-	nc, err := nats.Connect("nats://" + config.AddrNats)
+// Creates the sink, or the pipeline when configured instead, reporting the
+// errors it fails with in the background
+func (svc *MetricsService) newSink(config *Configuration) (timeseries.Sink, error) {
+	sink, err := config.newSink()
 	if err != nil {
 		return nil, err
 	}
-	ec, err := nats.NewEncodedConn(nc, protobuf.PROTOBUF_ENCODER)
+	if r, ok := sink.(timeseries.ErrorReporter); ok {
+		r.ReportErrors(svc.reportError)
+	}
+	return sink, nil
+}
+
+func (config *Configuration) newSink() (timeseries.Sink, error) {
+	if config.Pipeline != nil {
+		sink, err := pipeline.New(config.Pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("failed creating pipeline: %s", err)
+		}
+		return sink, nil
+	}
+	sink, err := timeseries.NewSink(config.Sink)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed creating %s sink: %s", config.Sink.Type, err)
+	}
+	return sink, nil
+}
+
+// Connects to the sink and NATS and starts consuming metrics. The service is
+// stopped when ctx is done, or when Stop is called. It may be started again
+// if starting fails.
+func (svc *MetricsService) Start(ctx context.Context) (err error) {
+	if !atomic.CompareAndSwapInt32(&svc.started, 0, 1) {
+		return ErrAlreadyStarted
+	}
+	defer func() {
+		if err != nil {
+			svc.stopNATSServer()
+			svc.reset()
+		}
+	}()
+
+	svc.processors, err = processor.NewChain(svc.config.Processors)
+	if err != nil {
+		return err
+	}
+	// first, as quarantines may publish through it
+	if svc.config.EmbeddedNATS != nil {
+		if svc.natsServer, err = natsserver.Start(svc.config.EmbeddedNATS); err != nil {
+			return err
+		}
+	}
+	svc.sink, err = svc.newSink(svc.config)
+	if err != nil {
+		return err
+	}
+
+	// start NATS client
+	svc.nc, err = svc.connect()
+	if err != nil {
+		svc.sink.Close()
+		return err
+	}
+
+	// queue metrics as they come
+	svc.instrument(instrument.Default)
+	for _, subject := range svc.config.Subjects {
+		if err := svc.subscribe(subject); err != nil {
+			svc.disconnect()
+			svc.sink.Close()
+			return err
+		}
+	}
+	for _, inputConfig := range svc.config.Inputs {
+		in, _ := input.NewInput(inputConfig) // validated already
+		if err := in.Start(svc.emitter(inputConfig.Name)); err != nil {
+			svc.stopInputs()
+			svc.disconnect()
+			svc.sink.Close()
+			return fmt.Errorf("failed starting input %s: %s", inputConfig.Name, err)
+		}
+		svc.inputs = append(svc.inputs, in)
+	}
+
+	go svc.run()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-svc.stop:
+		}
+		svc.result = svc.shutdown()
+		close(svc.done)
+	}()
+
+	return nil
+}
+
+// Forgets what a failed Start set up, once it has been released, so that the
+// service may be started again
+func (svc *MetricsService) reset() {
+	svc.mu.Lock()
+	svc.sink = nil
+	svc.processors = nil
+	svc.mu.Unlock()
+	svc.subsMu.Lock()
+	svc.subs = make(map[string]*subscription)
+	svc.subsMu.Unlock()
+	svc.inputs = nil
+	svc.nc = nil
+	svc.natsServer = nil
+	atomic.StoreInt32(&svc.natsClosed, 0)
+	atomic.StoreInt32(&svc.started, 0)
+}
+
+// Stops consuming metrics, writes every point received so far and flushes the
+// sink, within the configured shutdown timeout. It does not wait for that to
+// happen, see Wait.
+func (svc *MetricsService) Stop() {
+	svc.stopOnce.Do(func() {
+		close(svc.stop)
+	})
+}
+
+// Waits for the service to stop, returning an error if points were lost while
+// stopping
+func (svc *MetricsService) Wait() error {
+	if atomic.LoadInt32(&svc.started) == 0 {
+		return ErrNotStarted
+	}
+	<-svc.done
+	return svc.result
+}
+
+// Checks the service is able to take metrics: it is consuming from NATS, its
+// sink is reachable and its queue is not close to full
+func (svc *MetricsService) Ready() error {
+	if atomic.LoadInt32(&svc.started) == 0 {
+		return ErrNotStarted
+	}
+	if svc.stopped() {
+		return ErrStopped
+	}
+	if err := svc.natsReady(); err != nil {
+		return err
+	}
+	if stats := svc.queue.stats(); float64(stats.Depth) > svc.config.ReadyQueueRatio*float64(stats.Capacity) {
+		return fmt.Errorf("queue is almost full (%d/%d)", stats.Depth, stats.Capacity)
+	}
+	// the backend of a paused sink is expected to be down
+	if p, ok := svc.currentSink().(timeseries.Pinger); ok && atomic.LoadInt32(&svc.paused) == 0 {
+		result := make(chan error, 1)
+		go func() {
+			result <- p.Ping()
+		}()
+		select {
+		case err := <-result:
+			if err != nil {
+				return fmt.Errorf("sink unreachable: %s", err)
+			}
+		case <-time.After(READY_TIMEOUT_MS * time.Millisecond):
+			return errors.New("sink unreachable: ping timed out")
+		}
+	}
+	return nil
+}
+
+// Pauses writes to the sink, which keeps points buffered and, once its buffer is
+// full, leaves them queued. Once the queue is full too, points are handled
+// according to the queue overflow policy.
+func (svc *MetricsService) Pause() error {
+	if atomic.LoadInt32(&svc.started) == 0 {
+		return ErrNotStarted
+	}
+	if svc.stopped() {
+		return ErrStopped
+	}
+	p, ok := svc.currentSink().(timeseries.Pauser)
+	if !ok {
+		return ErrCannotPause
+	}
+	p.Pause()
+	atomic.StoreInt32(&svc.paused, 1)
+	return nil
+}
+
+// Resumes writes to the sink, see Pause
+func (svc *MetricsService) Resume() error {
+	if atomic.LoadInt32(&svc.started) == 0 {
+		return ErrNotStarted
+	}
+	if svc.stopped() {
+		return ErrStopped
+	}
+	return svc.resume()
+}
+
+func (svc *MetricsService) resume() error {
+	p, ok := svc.currentSink().(timeseries.Pauser)
+	if !ok {
+		return ErrCannotPause
+	}
+	p.Resume()
+	atomic.StoreInt32(&svc.paused, 0)
+	return nil
+}
+
+// Writes the points buffered by the sink right away, even when paused
+func (svc *MetricsService) Flush() error {
+	if atomic.LoadInt32(&svc.started) == 0 {
+		return ErrNotStarted
+	}
+	if svc.stopped() {
+		return ErrStopped
+	}
+	return svc.currentSink().Flush()
+}
+
+// Starts consuming metrics from another subject
+func (svc *MetricsService) Subscribe(subject string) error {
+	if atomic.LoadInt32(&svc.started) == 0 {
+		return ErrNotStarted
+	}
+	return svc.subscribe(subject)
+}
+
+// Stops consuming metrics from subject, once the messages already received on
+// it are queued or the shutdown timeout elapsed
+func (svc *MetricsService) Unsubscribe(subject string) error {
+	if atomic.LoadInt32(&svc.started) == 0 {
+		return ErrNotStarted
+	}
+	svc.subsMu.Lock()
+	if svc.stopped() {
+		svc.subsMu.Unlock()
+		return ErrStopped
+	}
+	sub, ok := svc.subs[subject]
+	if !ok {
+		svc.subsMu.Unlock()
+		return fmt.Errorf("not subscribed to %s", subject)
+	}
+	delete(svc.subs, subject)
+	svc.subsMu.Unlock()
+	// the service may be stopping meanwhile, which drains it too
+	return svc.drainSubscription(sub, svc.stop)
+}
+
+// Applies the processors, sink and subjects of config, leaving any other setting
+// as it was. The sink is only replaced when its configuration changed, in which
+// case the previous one writes the points it buffered before being closed.
+func (svc *MetricsService) Reload(config *Configuration) error {
+	if atomic.LoadInt32(&svc.started) == 0 {
+		return ErrNotStarted
 	}
+	if svc.stopped() {
+		return ErrStopped
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	svc.reloadMu.Lock()
+	defer svc.reloadMu.Unlock()
+	processors, err := processor.NewChain(config.Processors)
+	if err != nil {
+		return err
+	}
+	var sink timeseries.Sink
+	if !reflect.DeepEqual(config.Sink, svc.config.Sink) || !reflect.DeepEqual(config.Pipeline, svc.config.Pipeline) {
+		if sink, err = svc.newSink(config); err != nil {
+			return err
+		}
+		if p, ok := sink.(timeseries.Pauser); ok && atomic.LoadInt32(&svc.paused) == 1 {
+			p.Pause()
+		}
+	}
+
+	svc.mu.Lock()
+	old := svc.sink
+	svc.processors = processors
+	svc.config.Processors = config.Processors
+	if sink != nil {
+		svc.sink = sink
+		svc.config.Sink = config.Sink
+		svc.config.Pipeline = config.Pipeline
+	}
+	svc.mu.Unlock()
+
+	var lastErr error
+	if sink != nil {
+		if err := svc.retire(old); err != nil {
+			lastErr = fmt.Errorf("failed flushing points of the previous sink: %s", err)
+		}
+	}
+	if err := svc.resubscribe(config.Subjects); err != nil {
+		lastErr = err
+	}
+	return lastErr
+}
 
-	// set-up nats
-	go func(ec *nats.EncodedConn, ts timeseries.TimeSeries) {
-		defer ec.Close()
-		defer close(svc.metricChan)
-		ec.BindRecvChan(SUBJECT, svc.metricChan)
-		for {
-			select {
-			case <-svc.quit:
-				close(ts.Stop())
-				return
-			case metric := <-svc.metricChan:
-				point := &influxdb.Point{
-					Measurement: metric.Name,
-					Tags:        metric.Tags,
-					Time:        transformTime(metric.Timestamp),
-					Fields:      transformFields(metric.Values),
-				}
-				ts.Points() <- point
+// Closes a sink replaced on reload, once the run loop is done writing to it
+func (svc *MetricsService) retire(sink timeseries.Sink) error {
+	// a paused sink may be blocking the run loop
+	if p, ok := sink.(timeseries.Pauser); ok {
+		p.Resume()
+	}
+	synced := make(chan struct{})
+	select {
+	case svc.synced <- synced:
+		<-synced
+	case <-svc.done:
+	}
+	return sink.Close()
+}
+
+// Subscribes to subjects not subscribed to yet, and unsubscribes from those not
+// listed
+func (svc *MetricsService) resubscribe(subjects []string) error {
+	wanted := make(map[string]bool, len(subjects))
+	var lastErr error
+	for _, subject := range subjects {
+		wanted[subject] = true
+		svc.subsMu.Lock()
+		_, ok := svc.subs[subject]
+		svc.subsMu.Unlock()
+		if !ok {
+			if err := svc.subscribe(subject); err != nil {
+				lastErr = err
 			}
 		}
+	}
+	for _, subject := range svc.Subscriptions() {
+		if !wanted[subject] {
+			if err := svc.Unsubscribe(subject); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
 
-	}(ec, ts)
+// Subjects metrics are consumed from, sorted
+func (svc *MetricsService) Subscriptions() []string {
+	svc.subsMu.Lock()
+	defer svc.subsMu.Unlock()
+	subjects := make([]string, 0, len(svc.subs))
+	for subject := range svc.subs {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
 
-	return svc.quit, nil
+// Errors found while running, e.g. invalid metrics, or points the sink
+// discarded after failing to write them. Errors are discarded when not read
+// fast enough.
+func (svc *MetricsService) Errors() <-chan error {
+	return svc.errs
 }
 
+func (svc *MetricsService) Stats() Stats {
+	stats := Stats{
+		Received:     atomic.LoadUint64(&svc.received),
+		Invalid:      atomic.LoadUint64(&svc.invalid),
+		SlowConsumer: atomic.LoadUint64(&svc.slowConsumer),
+		Paused:       atomic.LoadInt32(&svc.paused) == 1,
+		Queue:        svc.queue.stats(),
+	}
+	sink := svc.currentSink()
+	if r, ok := sink.(timeseries.StatsReporter); ok {
+		stats.Sink = r.Stats()
+	}
+	if r, ok := sink.(timeseries.BackendStatsReporter); ok {
+		stats.Backends = r.BackendStats()
+	}
+	return stats
+}
+
+func (svc *MetricsService) currentSink() timeseries.Sink {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	return svc.sink
+}
+
+func (svc *MetricsService) stopped() bool {
+	select {
+	case <-svc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (svc *MetricsService) reportError(err error) {
+	select {
+	case svc.errs <- err:
+	default:
+	}
+}
+
+// Registers the service's counters, measured as metricas_service and
+// metricas_queue
+func (svc *MetricsService) instrument(r *instrument.Registry) {
+	r.Gauge("metricas_service", nil, "slow_consumer", func() int64 {
+		return int64(atomic.LoadUint64(&svc.slowConsumer))
+	})
+	r.Gauge("metricas_queue", nil, "points_queued", func() int64 {
+		return int64(len(svc.queue.points))
+	})
+	r.Gauge("metricas_queue", nil, "points_dropped", func() int64 {
+		return int64(svc.queue.stats().Dropped)
+	})
+}
+
+func (svc *MetricsService) subscribe(subject string) error {
+	svc.subsMu.Lock()
+	defer svc.subsMu.Unlock()
+	if svc.stopped() {
+		return ErrStopped
+	}
+	if _, ok := svc.subs[subject]; ok {
+		return fmt.Errorf("already subscribed to %s", subject)
+	}
+	sub := &subscription{}
+	var err error
+	sub.Subscription, err = svc.nc.Subscribe(subject, svc.handler(subject, &sub.handled))
+	if err != nil {
+		return fmt.Errorf("failed subscribing to %s: %s", subject, err)
+	}
+	svc.subs[subject] = sub
+	return nil
+}
+
+// Handles messages received on a subscription to subject, counting them in
+// handled
+func (svc *MetricsService) handler(subject string, handled *uint64) nats.MsgHandler {
+	tags := map[string]string{"subject": subject}
+	received := instrument.Default.Counter("metricas_nats", tags, "messages_received")
+	invalid := instrument.Default.Counter("metricas_nats", tags, "decode_errors")
+	return func(msg *nats.Msg) {
+		// counted once handled, see drainSubscription
+		defer atomic.AddUint64(handled, 1)
+		defer atomic.AddUint64(&svc.received, 1)
+		received.Inc()
+		metric := &api.Metric{}
+		if err := proto.Unmarshal(msg.Data, metric); err != nil {
+			atomic.AddUint64(&svc.invalid, 1)
+			invalid.Inc()
+			svc.reportError(fmt.Errorf("discarding invalid metric received on %s: %s", msg.Subject, err))
+			return
+		}
+		point := transformMetric(metric)
+		point.Source = msg.Subject
+		point.Received = time.Now()
+		svc.queue.push(point)
+	}
+}
+
+// Returns the function inputs hand their points to, queueing them with the
+// input name as their source unless they have one already
+func (svc *MetricsService) emitter(name string) func(point *timeseries.Point) {
+	return func(point *timeseries.Point) {
+		if point.Source == "" {
+			point.Source = name
+		}
+		point.Received = time.Now()
+		svc.queue.push(point)
+	}
+}
+
+// Writes queued metrics, and internal measurements every InstrumentInterval
+func (svc *MetricsService) run() {
+	report := time.NewTicker(REPORT_INTERVAL_MS * time.Millisecond)
+	defer report.Stop()
+	var measure <-chan time.Time
+	if svc.config.InstrumentInterval > 0 {
+		ticker := time.NewTicker(svc.config.InstrumentInterval)
+		defer ticker.Stop()
+		measure = ticker.C
+	}
+	var lastDropped uint64
+	for {
+		select {
+		case <-svc.drain:
+			// nothing else is coming, write what is left
+			for len(svc.queue.points) > 0 {
+				svc.process(<-svc.queue.points)
+			}
+			svc.closed <- svc.currentSink().Close()
+			return
+		case point := <-svc.queue.points:
+			svc.process(point)
+		case synced := <-svc.synced:
+			close(synced)
+		case <-report.C:
+			lastDropped = svc.reportOverload(lastDropped)
+		case now := <-measure:
+			svc.writeMeasurements(now)
+		}
+	}
+}
+
+// Writes the internal measurements, tagged with the host name
+func (svc *MetricsService) writeMeasurements(now time.Time) {
+	host, _ := os.Hostname()
+	for _, m := range instrument.Default.Snapshot() {
+		tags := map[string]string{"host": host}
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+		svc.write(&timeseries.Point{
+			Measurement: m.Name,
+			Tags:        tags,
+			Fields:      m.Fields,
+			Time:        now,
+			Source:      INTERNAL_SOURCE,
+		})
+	}
+}
+
+// Runs a point through the processors and writes what comes out of them
+func (svc *MetricsService) process(point *timeseries.Point) {
+	svc.mu.Lock()
+	processors := svc.processors
+	svc.mu.Unlock()
+	if point = processors.Process(point); point != nil {
+		svc.write(point)
+	}
+}
+
+func (svc *MetricsService) write(point *timeseries.Point) {
+	if err := svc.currentSink().Write(point); err != nil {
+		svc.reportError(fmt.Errorf("failed writing point: %s", err))
+	}
+}
+
+// Stops consuming from NATS, writes every point received so far and flushes
+// the sink, within the configured timeout
+func (svc *MetricsService) shutdown() error {
+	result := make(chan error, 1)
+	go func() {
+		// a paused sink would not take what is left
+		svc.resume()
+		svc.stopConsuming()
+		close(svc.drain)
+		err := <-svc.closed
+		// once the sink, whose quarantines may publish through it, is closed
+		svc.stopNATSServer()
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("failed flushing points: %s", err)
+		}
+		return nil
+	case <-time.After(svc.config.ShutdownTimeout):
+		pending := uint64(len(svc.queue.points))
+		if r, ok := svc.currentSink().(timeseries.StatsReporter); ok {
+			pending += r.Stats().Buffered
+		}
+		return fmt.Errorf("%s after %s, %d points were not written", ErrShutdownTimeout, svc.config.ShutdownTimeout, pending)
+	}
+}
+
+// Stops inputs, unsubscribes from all subjects and disconnects from NATS
+func (svc *MetricsService) stopConsuming() {
+	svc.stopInputs()
+	defer svc.disconnect()
+	svc.subsMu.Lock()
+	defer svc.subsMu.Unlock()
+	for subject, sub := range svc.subs {
+		if err := svc.drainSubscription(sub, nil); err != nil {
+			svc.reportError(fmt.Errorf("failed unsubscribing from %s: %s", subject, err))
+		}
+	}
+}
+
+// Stops inputs, waiting for the points they received to be queued
+func (svc *MetricsService) stopInputs() {
+	for i, in := range svc.inputs {
+		if err := in.Stop(); err != nil {
+			svc.reportError(fmt.Errorf("failed stopping input %s: %s", svc.config.Inputs[i].Name, err))
+		}
+	}
+}
+
+// Unsubscribes, waiting for the messages already received by the NATS client
+// to be handled, for at most the shutdown timeout or until abort is closed
+func (svc *MetricsService) drainSubscription(sub *subscription, abort <-chan struct{}) error {
+	queued, err := sub.QueuedMsgs()
+	if err != nil {
+		return err
+	}
+	target := atomic.LoadUint64(&sub.handled) + uint64(queued)
+	if err := sub.AutoUnsubscribe(int(target)); err != nil {
+		return err
+	}
+	timeout := time.After(svc.config.ShutdownTimeout)
+	for atomic.LoadUint64(&sub.handled) < target && sub.IsValid() {
+		select {
+		case <-abort:
+			return nil
+		case <-timeout:
+			return fmt.Errorf("%d messages were not handled after %s", target-atomic.LoadUint64(&sub.handled), svc.config.ShutdownTimeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// Called by NATS on asynchronous errors, e.g. when it drops messages because
+// they are not consumed fast enough
+func (svc *MetricsService) handleNatsError(nc *nats.Conn, sub *nats.Subscription, err error) {
+	if err == nats.ErrSlowConsumer {
+		atomic.AddUint64(&svc.slowConsumer, 1)
+		stats := svc.queue.stats()
+		svc.reportError(fmt.Errorf("NATS is dropping messages on %s, slow consumer (queue %d/%d, overflow policy %s)", sub.Subject, stats.Depth, stats.Capacity, svc.queue.policy))
+		return
+	}
+	svc.reportError(fmt.Errorf("NATS error: %s", err))
+}
+
+// Reports points dropped since the last report, returning the total dropped
+func (svc *MetricsService) reportOverload(lastDropped uint64) uint64 {
+	stats := svc.queue.stats()
+	if stats.Dropped > lastDropped {
+		svc.reportError(fmt.Errorf("dropped %d points in the last %s, overflow policy %s (queue %d/%d)", stats.Dropped-lastDropped, REPORT_INTERVAL_MS*time.Millisecond, svc.queue.policy, stats.Depth, stats.Capacity))
+	}
+	return stats.Dropped
+}
+
+func transformMetric(metric *api.Metric) *timeseries.Point {
+	return &timeseries.Point{
+		Measurement: metric.Name,
+		Tags:        metric.Tags,
+		Time:        transformTime(metric.Timestamp),
+		Fields:      transformFields(metric.Values),
+		Producer:    metric.ProducerId,
+		Sequence:    metric.Sequence,
+	}
+}
+
+// Metrics without timestamp, or with a zero one, get no time rather than the
+// Unix epoch, see the timestamps processor
 func transformTime(t *api.Timestamp) time.Time {
+	if t == nil || (t.Seconds == 0 && t.Nanos == 0) {
+		return time.Time{}
+	}
 	return time.Unix(t.Seconds, int64(t.Nanos))
 }
 
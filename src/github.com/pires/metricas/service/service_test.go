@@ -0,0 +1,205 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/nats"
+
+	"github.com/pires/metricas/api"
+	"github.com/pires/metricas/timeseries"
+)
+
+// Runs a NATS server on the given port, a random one when 0
+func runNATSServer(t *testing.T, port int) *server.Server {
+	if port == 0 {
+		port = server.RANDOM_PORT
+	}
+	s := server.New(&server.Options{Host: "127.0.0.1", Port: port, NoSigs: true})
+	go s.Start()
+	for deadline := time.Now().Add(5 * time.Second); s.Addr() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("NATS server not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s
+}
+
+// Returns a port nothing listens on
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// Configures a service writing to a file in dir
+func testConfiguration(addr, dir string) *Configuration {
+	return &Configuration{
+		AddrNats: addr,
+		Sink: &timeseries.SinkConfiguration{
+			Type: timeseries.SINK_FILE,
+			File: &timeseries.FileConfiguration{Path: filepath.Join(dir, "points.lp")},
+		},
+	}
+}
+
+func publishMetrics(t *testing.T, addr string, n int) {
+	nc, err := nats.Connect("nats://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	for i := 0; i < n; i++ {
+		data, err := proto.Marshal(&api.Metric{
+			Name:      "cpu",
+			Timestamp: &api.Timestamp{Seconds: 1434055562, Nanos: int32(i)},
+			Values:    map[string]int64{"value": int64(i)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nc.Publish(SUBJECT, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// and one that is not a metric
+	nc.Publish(SUBJECT, []byte("not a metric"))
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	s := runNATSServer(t, 0)
+	defer s.Shutdown()
+	addr := s.Addr().String()
+	dir, err := ioutil.TempDir("", "metricas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	svc, err := NewMetricsService(testConfiguration(addr, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Wait(); err != ErrNotStarted {
+		t.Errorf("waiting before starting: got %v, want %s", err, ErrNotStarted)
+	}
+	if err := svc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Start(context.Background()); err != ErrAlreadyStarted {
+		t.Errorf("starting twice: got %v, want %s", err, ErrAlreadyStarted)
+	}
+
+	publishMetrics(t, addr, 10)
+	// messages received before stopping are written
+	for deadline := time.Now().Add(5 * time.Second); svc.Stats().Received < 11; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages received, want 11", svc.Stats().Received)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	svc.Stop()
+	svc.Stop()
+	if err := svc.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := svc.Stats()
+	if stats.Received != 11 || stats.Invalid != 1 {
+		t.Errorf("%d messages received, %d invalid, want 11 and 1", stats.Received, stats.Invalid)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "points.lp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 10 {
+		t.Errorf("%d points written, want 10:\n%s", lines, data)
+	}
+	select {
+	case err := <-svc.Errors():
+		if err == nil {
+			t.Error("nil error reported")
+		}
+	default:
+		t.Error("invalid metric not reported")
+	}
+}
+
+func TestServiceStoppedByContext(t *testing.T) {
+	s := runNATSServer(t, 0)
+	defer s.Shutdown()
+	dir, err := ioutil.TempDir("", "metricas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	svc, err := NewMetricsService(testConfiguration(s.Addr().String(), dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := svc.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("service not stopped once its context is done")
+	}
+}
+
+func TestServiceStartedAgainAfterFailing(t *testing.T) {
+	port := freePort(t)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	dir, err := ioutil.TempDir("", "metricas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	svc, err := NewMetricsService(testConfiguration(addr, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Start(context.Background()); err == nil {
+		t.Fatal("started without NATS")
+	}
+	if err := svc.Wait(); err != ErrNotStarted {
+		t.Errorf("waiting after failing to start: got %v, want %s", err, ErrNotStarted)
+	}
+
+	s := runNATSServer(t, port)
+	defer s.Shutdown()
+	if err := svc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	svc.Stop()
+	if err := svc.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,73 @@
+package timeseries
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ADAPTIVE_RANGE = 8 // batches shrink and flushes slow down by up to 8 times
+)
+
+// Batch size and flush interval, shrinking and slowing down respectively when
+// writes take longer than the target latency, and recovering when they take
+// less than half of it
+type adaptiveBatching struct {
+	target      time.Duration
+	minPoints   int64
+	maxPoints   int64
+	minInterval time.Duration
+	maxInterval time.Duration
+	// updated atomically
+	points   int64
+	interval int64
+}
+
+func newAdaptiveBatching(target time.Duration, maxPoints int, minInterval time.Duration) *adaptiveBatching {
+	a := &adaptiveBatching{
+		target:      target,
+		minPoints:   int64(maxPoints / ADAPTIVE_RANGE),
+		maxPoints:   int64(maxPoints),
+		minInterval: minInterval,
+		maxInterval: minInterval * ADAPTIVE_RANGE,
+		points:      int64(maxPoints),
+		interval:    int64(minInterval),
+	}
+	if a.minPoints < 1 {
+		a.minPoints = 1
+	}
+	return a
+}
+
+func (a *adaptiveBatching) batchSize() int {
+	return int(atomic.LoadInt64(&a.points))
+}
+
+func (a *adaptiveBatching) flushInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&a.interval))
+}
+
+// Adapts to the latency of a write, halving batches and doubling the
+// interval when slow, growing batches by the minimum size and halving the
+// interval when fast
+func (a *adaptiveBatching) observe(latency time.Duration) {
+	points, interval := atomic.LoadInt64(&a.points), time.Duration(atomic.LoadInt64(&a.interval))
+	switch {
+	case latency > a.target:
+		if points /= 2; points < a.minPoints {
+			points = a.minPoints
+		}
+		if interval *= 2; interval > a.maxInterval {
+			interval = a.maxInterval
+		}
+	case latency < a.target/2:
+		if points += a.minPoints; points > a.maxPoints {
+			points = a.maxPoints
+		}
+		if interval /= 2; interval < a.minInterval {
+			interval = a.minInterval
+		}
+	}
+	atomic.StoreInt64(&a.points, points)
+	atomic.StoreInt64(&a.interval, int64(interval))
+}
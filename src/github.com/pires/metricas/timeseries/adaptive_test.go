@@ -0,0 +1,46 @@
+package timeseries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveBatching(t *testing.T) {
+	const target = 100 * time.Millisecond
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		points    int
+		interval  time.Duration
+	}{
+		{"starts at the largest batches and shortest interval", nil, 800, time.Second},
+		{"slow writes halve batches and double the interval", []time.Duration{200 * time.Millisecond}, 400, 2 * time.Second},
+		{"shrinks down to an eighth", []time.Duration{time.Second, time.Second, time.Second, time.Second, time.Second}, 100, 8 * time.Second},
+		{"on target writes change nothing", []time.Duration{200 * time.Millisecond, target, target / 2}, 400, 2 * time.Second},
+		{"fast writes grow batches and halve the interval", []time.Duration{time.Second, time.Second, 10 * time.Millisecond}, 300, 2 * time.Second},
+		{"recovers up to the configured size", []time.Duration{time.Second, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 800, time.Second},
+	}
+	for _, test := range tests {
+		a := newAdaptiveBatching(target, 800, time.Second)
+		for _, latency := range test.latencies {
+			a.observe(latency)
+		}
+		if points := a.batchSize(); points != test.points {
+			t.Errorf("%s: batches of %d points, want %d", test.name, points, test.points)
+		}
+		if interval := a.flushInterval(); interval != test.interval {
+			t.Errorf("%s: flush interval %s, want %s", test.name, interval, test.interval)
+		}
+	}
+}
+
+func TestAdaptiveBatchingSmallBatches(t *testing.T) {
+	// batches never shrink to nothing
+	a := newAdaptiveBatching(time.Millisecond, 4, time.Second)
+	for i := 0; i < 10; i++ {
+		a.observe(time.Second)
+	}
+	if points := a.batchSize(); points != 1 {
+		t.Errorf("batches of %d points, want 1", points)
+	}
+}
@@ -0,0 +1,72 @@
+package timeseries
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BREAKER_COOLDOWN_MS = 10000 // how long the breaker stays open before InfluxDB is probed
+
+	BREAKER_CLOSED    = 0 // points are written
+	BREAKER_OPEN      = 1 // points are held, InfluxDB failing
+	BREAKER_HALF_OPEN = 2 // InfluxDB answered a probe, the next write decides
+)
+
+var errBreakerOpen = errors.New("timeseries: circuit breaker open, InfluxDB is failing")
+
+// Stops writing to a failing InfluxDB after threshold consecutive failed
+// writes, until it answers a ping after cooldown and a write succeeds again.
+// It is only used by the goroutine of the sink, but for its state, read by
+// instrumentation.
+type breaker struct {
+	addr      string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	state     int64 // updated atomically
+}
+
+func (b *breaker) isOpen() bool {
+	return atomic.LoadInt64(&b.state) == BREAKER_OPEN
+}
+
+// Whether the breaker has been open long enough to probe InfluxDB
+func (b *breaker) cooledDown(now time.Time) bool {
+	return b.isOpen() && now.Sub(b.openedAt) >= b.cooldown
+}
+
+// Lets a write through after InfluxDB answered a probe, or waits another
+// cooldown
+func (b *breaker) probed(now time.Time, err error) {
+	if err != nil {
+		b.openedAt = now
+		return
+	}
+	log.Printf("InfluxDB %s answered, trying to write to it again.", b.addr)
+	atomic.StoreInt64(&b.state, BREAKER_HALF_OPEN)
+}
+
+func (b *breaker) succeeded() {
+	if atomic.LoadInt64(&b.state) != BREAKER_CLOSED {
+		log.Printf("InfluxDB %s recovered, closing circuit breaker.", b.addr)
+	}
+	b.failures = 0
+	atomic.StoreInt64(&b.state, BREAKER_CLOSED)
+}
+
+// Counts a failed write, returning whether it opened the breaker
+func (b *breaker) failed(now time.Time) bool {
+	b.failures++
+	state := atomic.LoadInt64(&b.state)
+	if state == BREAKER_OPEN || (state == BREAKER_CLOSED && b.failures < b.threshold) {
+		return false
+	}
+	log.Printf("Writes to InfluxDB %s failed %d times in a row, opening circuit breaker for %s.", b.addr, b.failures, b.cooldown)
+	b.openedAt = now
+	atomic.StoreInt64(&b.state, BREAKER_OPEN)
+	return true
+}
@@ -0,0 +1,93 @@
+package timeseries
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	type step struct {
+		event  string        // fail, succeed, probe or probe-error
+		after  time.Duration // since the breaker was created
+		opened bool          // whether a failure opened the breaker
+		state  int64
+		cooled bool // whether InfluxDB may be probed
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"opens after threshold failures", []step{
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, true, BREAKER_OPEN, false},
+			{"fail", 0, false, BREAKER_OPEN, false},
+		}},
+		{"successes reset failures", []step{
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"succeed", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, false, BREAKER_CLOSED, false},
+		}},
+		{"cools down before probing", []step{
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", time.Second, true, BREAKER_OPEN, false},
+			{"", 10 * time.Second, false, BREAKER_OPEN, false},
+			{"", 11 * time.Second, false, BREAKER_OPEN, true},
+		}},
+		{"failed probes wait another cooldown", []step{
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, true, BREAKER_OPEN, false},
+			{"probe-error", 10 * time.Second, false, BREAKER_OPEN, false},
+			{"", 19 * time.Second, false, BREAKER_OPEN, false},
+			{"", 20 * time.Second, false, BREAKER_OPEN, true},
+		}},
+		{"half open closes on success", []step{
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, true, BREAKER_OPEN, false},
+			{"probe", 10 * time.Second, false, BREAKER_HALF_OPEN, false},
+			{"succeed", 10 * time.Second, false, BREAKER_CLOSED, false},
+			{"fail", 10 * time.Second, false, BREAKER_CLOSED, false},
+		}},
+		{"half open opens again on the first failure", []step{
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, false, BREAKER_CLOSED, false},
+			{"fail", 0, true, BREAKER_OPEN, false},
+			{"probe", 10 * time.Second, false, BREAKER_HALF_OPEN, false},
+			{"fail", 10 * time.Second, true, BREAKER_OPEN, false},
+			{"", 20 * time.Second, false, BREAKER_OPEN, true},
+		}},
+	}
+	start := time.Unix(1434055562, 0)
+	for _, test := range tests {
+		b := &breaker{addr: "localhost:8086", threshold: 3, cooldown: 10 * time.Second}
+		for i, s := range test.steps {
+			now := start.Add(s.after)
+			var opened bool
+			switch s.event {
+			case "fail":
+				opened = b.failed(now)
+			case "succeed":
+				b.succeeded()
+			case "probe":
+				b.probed(now, nil)
+			case "probe-error":
+				b.probed(now, errors.New("connection refused"))
+			}
+			if opened != s.opened {
+				t.Errorf("%s, step %d: opened %t, want %t", test.name, i, opened, s.opened)
+			}
+			if b.state != s.state {
+				t.Errorf("%s, step %d: state %d, want %d", test.name, i, b.state, s.state)
+			}
+			if cooled := b.cooledDown(now); cooled != s.cooled {
+				t.Errorf("%s, step %d: cooled down %t, want %t", test.name, i, cooled, s.cooled)
+			}
+		}
+	}
+}
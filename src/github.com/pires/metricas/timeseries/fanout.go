@@ -0,0 +1,295 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	SINK_FANOUT = "fanout"
+
+	FANOUT_BUFFER_SIZE = 8192 // points queued per backend
+)
+
+type FanoutConfiguration struct {
+	// backends every point is written to
+	Sinks []*SinkConfiguration
+	// points queued per backend before new ones are dropped, defaults to
+	// FANOUT_BUFFER_SIZE
+	BufferSize int
+}
+
+func init() {
+	RegisterSink(SINK_FANOUT, func(config *SinkConfiguration) (Sink, error) {
+		if config.Fanout == nil {
+			return nil, errors.New("missing fan-out sink configuration")
+		}
+		return NewFanoutSink(config.Fanout)
+	})
+}
+
+// Writes every point to several backends. Each backend has its own queue,
+// drained by its own goroutine, so that a slow or failing backend drops its
+// share of points instead of stalling the others.
+type fanoutSink struct {
+	backends []*fanoutBackend
+}
+
+type fanoutBackend struct {
+	name      string
+	sink      Sink
+	queue     chan *Point
+	flushChan chan chan error
+	stop      chan struct{}
+	pauseChan chan bool
+	done      chan error
+	report    atomic.Value // func(error), see ReportErrors
+	// updated atomically
+	written uint64
+	failed  uint64
+	dropped uint64
+}
+
+func NewFanoutSink(config *FanoutConfiguration) (Sink, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	fs := &fanoutSink{}
+	for i, backendConfig := range config.Sinks {
+		name := config.backendName(i)
+		sink, err := NewSink(backendConfig)
+		if err != nil {
+			fs.Close()
+			return nil, fmt.Errorf("fan-out backend %s: %s", name, err)
+		}
+		b := &fanoutBackend{
+			name:      name,
+			sink:      sink,
+			queue:     make(chan *Point, config.BufferSize),
+			flushChan: make(chan chan error),
+			pauseChan: make(chan bool),
+			stop:      make(chan struct{}),
+			done:      make(chan error, 1),
+		}
+		fs.backends = append(fs.backends, b)
+		go b.run()
+	}
+
+	return fs, nil
+}
+
+func (config *FanoutConfiguration) validate() error {
+	if len(config.Sinks) == 0 {
+		return errors.New("fan-out sink needs at least one backend")
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = FANOUT_BUFFER_SIZE
+	}
+	for i, backendConfig := range config.Sinks {
+		if err := backendConfig.Validate(); err != nil {
+			return fmt.Errorf("fan-out backend %s: %s", config.backendName(i), err)
+		}
+	}
+	return nil
+}
+
+// Backends are named after their type and position unless named otherwise
+func (config *FanoutConfiguration) backendName(i int) string {
+	if name := config.Sinks[i].Name; name != "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%d", config.Sinks[i].Type, i)
+}
+
+// Queues the point for every backend, dropping it for those that are full
+func (fs *fanoutSink) Write(point *Point) error {
+	for _, b := range fs.backends {
+		select {
+		case b.queue <- point:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+	return nil
+}
+
+// Flushes all backends in parallel, returning the first error
+func (fs *fanoutSink) Flush() error {
+	return fs.each(func(b *fanoutBackend) error {
+		result := make(chan error, 1)
+		select {
+		case b.flushChan <- result:
+			return <-result
+		case <-b.stop:
+			return ErrSinkClosed
+		}
+	})
+}
+
+func (fs *fanoutSink) Close() error {
+	// paused backends would not take the points left in their queue
+	fs.Resume()
+	return fs.each(func(b *fanoutBackend) error {
+		close(b.stop)
+		return <-b.done
+	})
+}
+
+// Pings all backends able to, returning the first error
+func (fs *fanoutSink) Ping() error {
+	return fs.each(func(b *fanoutBackend) error {
+		if p, ok := b.sink.(Pinger); ok {
+			return p.Ping()
+		}
+		return nil
+	})
+}
+
+// Reports errors of the backends, and the first write each fails
+func (fs *fanoutSink) ReportErrors(report func(error)) {
+	for _, b := range fs.backends {
+		b.report.Store(report)
+		if r, ok := b.sink.(ErrorReporter); ok {
+			r.ReportErrors(report)
+		}
+	}
+}
+
+// Pauses all backends able to. Points keep being queued for them, and dropped
+// once their queue is full.
+func (fs *fanoutSink) Pause() {
+	for _, b := range fs.backends {
+		if p, ok := b.sink.(Pauser); ok && b.setPaused(true) {
+			p.Pause()
+		}
+	}
+}
+
+func (fs *fanoutSink) Resume() {
+	for _, b := range fs.backends {
+		if p, ok := b.sink.(Pauser); ok {
+			p.Resume()
+			b.setPaused(false)
+		}
+	}
+}
+
+// Aggregated statistics of all backends
+func (fs *fanoutSink) Stats() Stats {
+	var total Stats
+	for _, stats := range fs.BackendStats() {
+		total.Add(stats)
+	}
+	return total
+}
+
+// Statistics of each backend, by name
+func (fs *fanoutSink) BackendStats() map[string]Stats {
+	stats := make(map[string]Stats, len(fs.backends))
+	for _, b := range fs.backends {
+		s := Stats{
+			Written: atomic.LoadUint64(&b.written),
+			Failed:  atomic.LoadUint64(&b.failed),
+			Dropped: atomic.LoadUint64(&b.dropped),
+		}
+		// what the backend itself knows is more accurate
+		if r, ok := b.sink.(StatsReporter); ok {
+			bs := r.Stats()
+			s.Written = bs.Written
+			s.Failed += bs.Failed
+			s.Dropped += bs.Dropped
+			s.Retries = bs.Retries
+			s.Buffered = bs.Buffered
+			s.OldestBuffered = bs.OldestBuffered
+		}
+		s.Buffered += uint64(len(b.queue))
+		stats[b.name] = s
+	}
+	return stats
+}
+
+// Runs f for every backend concurrently, returning the first error
+func (fs *fanoutSink) each(f func(b *fanoutBackend) error) error {
+	errs := make(chan error, len(fs.backends))
+	var wg sync.WaitGroup
+	for _, b := range fs.backends {
+		wg.Add(1)
+		go func(b *fanoutBackend) {
+			defer wg.Done()
+			if err := f(b); err != nil {
+				errs <- fmt.Errorf("fan-out backend %s: %s", b.name, err)
+			}
+		}(b)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// Hands queued points to the backend
+func (b *fanoutBackend) run() {
+	paused := false
+	for {
+		queue := b.queue
+		if paused {
+			// a paused backend blocks writers once its buffer is full, so
+			// points are left queued instead
+			queue = nil
+		}
+		select {
+		case <-b.stop:
+			b.drain()
+			b.done <- b.sink.Close()
+			return
+		case point := <-queue:
+			b.write(point)
+		case result := <-b.flushChan:
+			if !paused {
+				b.drain()
+			}
+			result <- b.sink.Flush()
+		case paused = <-b.pauseChan:
+		}
+	}
+}
+
+// Tells the goroutine of the backend whether it is paused, returning false
+// once the backend is closed
+func (b *fanoutBackend) setPaused(paused bool) bool {
+	select {
+	case b.pauseChan <- paused:
+		return true
+	case <-b.stop:
+		return false
+	}
+}
+
+// Writes all points currently queued
+func (b *fanoutBackend) drain() {
+	for {
+		select {
+		case point := <-b.queue:
+			b.write(point)
+		default:
+			return
+		}
+	}
+}
+
+func (b *fanoutBackend) write(point *Point) {
+	if err := b.sink.Write(point); err != nil {
+		if atomic.AddUint64(&b.failed, 1) == 1 {
+			if report, ok := b.report.Load().(func(error)); ok {
+				report(fmt.Errorf("fan-out backend %s failed writing point: %s", b.name, err))
+			} else {
+				log.Printf("Fan-out backend %s failed writing point: %s", b.name, err)
+			}
+		}
+		return
+	}
+	atomic.AddUint64(&b.written, 1)
+}
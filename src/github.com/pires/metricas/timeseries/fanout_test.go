@@ -0,0 +1,252 @@
+package timeseries
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const SINK_TEST = "test"
+
+// Sinks created by the test sink type, by name
+var testSinks = struct {
+	sync.Mutex
+	m map[string]*testSink
+}{m: make(map[string]*testSink)}
+
+func init() {
+	RegisterSink(SINK_TEST, func(config *SinkConfiguration) (Sink, error) {
+		testSinks.Lock()
+		defer testSinks.Unlock()
+		return testSinks.m[config.Name], nil
+	})
+}
+
+// Records what it is asked to do. Writes signal entered and block until block
+// is closed, if set, and fail with writeErr.
+type testSink struct {
+	mu       sync.Mutex
+	written  []*Point
+	flushed  int
+	closed   int
+	paused   bool
+	writeErr error
+	flushErr error
+	block    chan struct{}
+	entered  chan struct{}
+}
+
+func (s *testSink) Write(point *Point) error {
+	if s.block != nil {
+		select {
+		case s.entered <- struct{}{}:
+		default:
+		}
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	s.written = append(s.written, point)
+	return nil
+}
+
+func (s *testSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushed++
+	return s.flushErr
+}
+
+func (s *testSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed++
+	return nil
+}
+
+func (s *testSink) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = true
+}
+
+func (s *testSink) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = false
+}
+
+func (s *testSink) count() (written, flushed, closed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.written), s.flushed, s.closed
+}
+
+// Creates a fan-out sink writing to the given test sinks, by name
+func newTestFanout(t *testing.T, bufferSize int, backends map[string]*testSink) *fanoutSink {
+	config := &FanoutConfiguration{BufferSize: bufferSize}
+	testSinks.Lock()
+	for name, sink := range backends {
+		testSinks.m[name] = sink
+		config.Sinks = append(config.Sinks, &SinkConfiguration{Name: name, Type: SINK_TEST})
+	}
+	testSinks.Unlock()
+	sink, err := NewFanoutSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink.(*fanoutSink)
+}
+
+// Waits for the sink to have been written n points
+func waitWritten(t *testing.T, name string, s *testSink, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		written, _, _ := s.count()
+		if written == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %d points written, want %d", name, written, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testPoint(i int) *Point {
+	return &Point{Measurement: "cpu", Fields: map[string]interface{}{"value": int64(i)}}
+}
+
+func TestFanoutSlowBackend(t *testing.T) {
+	slow := &testSink{block: make(chan struct{}), entered: make(chan struct{}, 1)}
+	fast := &testSink{}
+	fs := newTestFanout(t, 4, map[string]*testSink{"slow": slow, "fast": fast})
+
+	// the slow backend takes the first point and blocks writing it, so that
+	// its queue fills up with the next 4 and the last 5 are dropped
+	fs.Write(testPoint(0))
+	<-slow.entered
+	waitWritten(t, "fast", fast, 1)
+	for i := 1; i < 10; i++ {
+		fs.Write(testPoint(i))
+		// not to drop points meant for the fast backend
+		waitWritten(t, "fast", fast, i+1)
+	}
+
+	stats := fs.BackendStats()
+	if s := stats["fast"]; s.Written != 10 || s.Dropped != 0 || s.Buffered != 0 {
+		t.Errorf("fast: stats %+v, want 10 written", s)
+	}
+	if s := stats["slow"]; s.Written != 0 || s.Dropped != 5 || s.Buffered != 4 {
+		t.Errorf("slow: stats %+v, want 5 dropped and 4 buffered", s)
+	}
+	if s := fs.Stats(); s.Written != 10 || s.Dropped != 5 || s.Buffered != 4 {
+		t.Errorf("stats %+v, want 10 written, 5 dropped and 4 buffered", s)
+	}
+
+	// closing writes what is left in the queue of the slow backend
+	close(slow.block)
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]*testSink{"slow": slow, "fast": fast} {
+		written, _, closed := s.count()
+		if want := map[string]int{"slow": 5, "fast": 10}[name]; written != want || closed != 1 {
+			t.Errorf("%s: %d points written and closed %d times, want %d and once", name, written, closed, want)
+		}
+	}
+	if s := fs.BackendStats()["slow"]; s.Written != 5 || s.Dropped != 5 || s.Buffered != 0 {
+		t.Errorf("slow: stats %+v after closing, want 5 written and 5 dropped", s)
+	}
+}
+
+func TestFanoutFailingBackend(t *testing.T) {
+	failing := &testSink{writeErr: errors.New("unreachable"), flushErr: errors.New("unreachable")}
+	working := &testSink{}
+	fs := newTestFanout(t, 16, map[string]*testSink{"failing": failing, "working": working})
+	defer fs.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := fs.Write(testPoint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := fs.Flush()
+	if err == nil || !strings.Contains(err.Error(), "fan-out backend failing: unreachable") {
+		t.Errorf("flush error %v, want the failing backend's", err)
+	}
+	if written, flushed, _ := working.count(); written != 10 || flushed != 1 {
+		t.Errorf("working: %d points written and flushed %d times, want 10 and once", written, flushed)
+	}
+	stats := fs.BackendStats()
+	if s := stats["failing"]; s.Written != 0 || s.Failed != 10 {
+		t.Errorf("failing: stats %+v, want 10 failed", s)
+	}
+	if s := stats["working"]; s.Written != 10 || s.Failed != 0 {
+		t.Errorf("working: stats %+v, want 10 written", s)
+	}
+}
+
+func TestFanoutFlush(t *testing.T) {
+	a, b := &testSink{}, &testSink{}
+	fs := newTestFanout(t, 16, map[string]*testSink{"a": a, "b": b})
+	defer fs.Close()
+
+	for i := 0; i < 10; i++ {
+		fs.Write(testPoint(i))
+	}
+	// points queued are written before the backends are flushed
+	if err := fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]*testSink{"a": a, "b": b} {
+		if written, flushed, _ := s.count(); written != 10 || flushed != 1 {
+			t.Errorf("%s: %d points written and flushed %d times, want 10 and once", name, written, flushed)
+		}
+	}
+}
+
+func TestFanoutClosePaused(t *testing.T) {
+	a, b := &testSink{}, &testSink{}
+	fs := newTestFanout(t, 16, map[string]*testSink{"a": a, "b": b})
+
+	fs.Pause()
+	for i := 0; i < 10; i++ {
+		fs.Write(testPoint(i))
+	}
+	// points are left queued while paused
+	time.Sleep(10 * time.Millisecond)
+	if s := fs.Stats(); s.Written != 0 || s.Buffered != 20 {
+		t.Errorf("stats %+v while paused, want 20 buffered", s)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fs.Close()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing paused backends blocks")
+	}
+	for name, s := range map[string]*testSink{"a": a, "b": b} {
+		written, _, closed := s.count()
+		if written != 10 || closed != 1 || s.paused {
+			t.Errorf("%s: %d points written, closed %d times, paused %t, want 10, once and resumed", name, written, closed, s.paused)
+		}
+	}
+
+	// a closed fan-out sink neither blocks flushing nor pausing
+	if err := fs.Flush(); err == nil {
+		t.Error("flushing a closed sink succeeds")
+	}
+	fs.Pause()
+}
@@ -0,0 +1,170 @@
+package timeseries
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	FIELD_CONFLICTS_COERCE     = "coerce"     // convert values to the known type when lossless, quarantine otherwise
+	FIELD_CONFLICTS_QUARANTINE = "quarantine" // quarantine points with values of another type
+
+	FIELD_TYPE_FLOAT   = "float"
+	FIELD_TYPE_INTEGER = "integer"
+	FIELD_TYPE_STRING  = "string"
+	FIELD_TYPE_BOOLEAN = "boolean"
+
+	FLOAT_MAX_EXACT_INTEGER = 1 << 53 // larger integers are rounded when converted to floats
+)
+
+// Known types of the fields of each measurement. InfluxDB rejects a whole
+// write when the type of a field differs from the one it already stores, so
+// points are checked against them before being written.
+type fieldTypes struct {
+	coerce bool
+	types  map[string]map[string]string // by measurement and field
+}
+
+func newFieldTypes(policy string) *fieldTypes {
+	return &fieldTypes{
+		coerce: policy == FIELD_CONFLICTS_COERCE,
+		types:  make(map[string]map[string]string),
+	}
+}
+
+// Learns the field types of a database from SHOW FIELD KEYS. Versions of
+// InfluxDB before 1.0 do not report them, leaving them to be learnt from the
+// points written.
+func (ft *fieldTypes) seed(client *influxClient, db string) error {
+	rows, err := client.Rows("SHOW FIELD KEYS", db)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		measurement, _ := row[SERIES_COLUMN].(string)
+		field, _ := row["fieldKey"].(string)
+		typ, _ := row["fieldType"].(string)
+		if measurement != "" && field != "" && typ != "" {
+			ft.learn(measurement, field, typ)
+		}
+	}
+	return nil
+}
+
+func (ft *fieldTypes) learn(measurement, field, typ string) {
+	fields, ok := ft.types[measurement]
+	if !ok {
+		fields = make(map[string]string)
+		ft.types[measurement] = fields
+	}
+	fields[field] = typ
+}
+
+// Returns the point with its fields coerced to the known types, if allowed
+// and needed, and whether they were, or an error naming the conflicting
+// field. Types of fields not seen before are learnt from points without
+// conflicts.
+func (ft *fieldTypes) check(point Point) (Point, bool, error) {
+	known := ft.types[point.Measurement]
+	var coerced map[string]interface{}
+	for k, v := range point.Fields {
+		expected, ok := known[k]
+		if !ok {
+			continue
+		}
+		typ := fieldType(v)
+		// points that cannot be written are skipped later on
+		if typ == expected || typ == "" {
+			continue
+		}
+		if ft.coerce {
+			if c, ok := coerceField(v, expected); ok {
+				if coerced == nil {
+					coerced = make(map[string]interface{}, len(point.Fields))
+				}
+				coerced[k] = c
+				continue
+			}
+		}
+		return point, false, fmt.Errorf("field %s of measurement %s is %s, already stored as %s", k, point.Measurement, typ, expected)
+	}
+	if coerced != nil {
+		// fields may be shared with other sinks
+		fields := make(map[string]interface{}, len(point.Fields))
+		for k, v := range point.Fields {
+			fields[k] = v
+		}
+		for k, v := range coerced {
+			fields[k] = v
+		}
+		point.Fields = fields
+	}
+	for k, v := range point.Fields {
+		if _, ok := known[k]; !ok && fieldType(v) != "" {
+			ft.learn(point.Measurement, k, fieldType(v))
+		}
+	}
+	return point, coerced != nil, nil
+}
+
+// Returns the InfluxDB type of a field value, as written by appendFieldValue,
+// none for integers beyond the int64 range, which it cannot write
+func fieldType(v interface{}) string {
+	switch v := v.(type) {
+	case int64, int, int8, int16, int32, uint8, uint16, uint32:
+		return FIELD_TYPE_INTEGER
+	case uint64:
+		if v > math.MaxInt64 {
+			return ""
+		}
+		return FIELD_TYPE_INTEGER
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return ""
+		}
+		return FIELD_TYPE_INTEGER
+	case float64, float32:
+		return FIELD_TYPE_FLOAT
+	case bool:
+		return FIELD_TYPE_BOOLEAN
+	}
+	return FIELD_TYPE_STRING
+}
+
+// Converts a field value to the given type, when no information is lost
+func coerceField(v interface{}, typ string) (interface{}, bool) {
+	switch typ {
+	case FIELD_TYPE_STRING:
+		return fmt.Sprint(v), true
+	case FIELD_TYPE_FLOAT:
+		if fieldType(v) != FIELD_TYPE_BOOLEAN {
+			s := fmt.Sprint(v)
+			f, err := strconv.ParseFloat(s, 64)
+			i, intErr := strconv.ParseInt(s, 10, 64)
+			switch {
+			case intErr == nil:
+				return f, err == nil && i >= -FLOAT_MAX_EXACT_INTEGER && i <= FLOAT_MAX_EXACT_INTEGER
+			case intErr.(*strconv.NumError).Err == strconv.ErrRange:
+				return nil, false
+			}
+			return f, err == nil
+		}
+	case FIELD_TYPE_INTEGER:
+		switch fieldType(v) {
+		case FIELD_TYPE_FLOAT:
+			f, _ := strconv.ParseFloat(fmt.Sprint(v), 64)
+			// only whole numbers
+			return int64(f), f == float64(int64(f))
+		case FIELD_TYPE_STRING:
+			i, err := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+			return i, err == nil
+		}
+	case FIELD_TYPE_BOOLEAN:
+		if fieldType(v) == FIELD_TYPE_STRING {
+			b, err := strconv.ParseBool(fmt.Sprint(v))
+			return b, err == nil
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,70 @@
+package timeseries
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFieldType(t *testing.T) {
+	tests := []struct {
+		v   interface{}
+		typ string
+	}{
+		{int64(1), FIELD_TYPE_INTEGER},
+		{int8(-1), FIELD_TYPE_INTEGER},
+		{uint32(1), FIELD_TYPE_INTEGER},
+		{uint64(math.MaxInt64), FIELD_TYPE_INTEGER},
+		{uint64(math.MaxInt64) + 1, ""},
+		{uint(1), FIELD_TYPE_INTEGER},
+		{0.5, FIELD_TYPE_FLOAT},
+		{float32(0.5), FIELD_TYPE_FLOAT},
+		{true, FIELD_TYPE_BOOLEAN},
+		{"1", FIELD_TYPE_STRING},
+	}
+	for _, test := range tests {
+		if typ := fieldType(test.v); typ != test.typ {
+			t.Errorf("%#v: got type %q, want %q", test.v, typ, test.typ)
+		}
+	}
+}
+
+func TestCoerceField(t *testing.T) {
+	tests := []struct {
+		v   interface{}
+		typ string
+		ok  bool
+		c   interface{}
+	}{
+		{int64(3), FIELD_TYPE_FLOAT, true, float64(3)},
+		{uint32(7), FIELD_TYPE_FLOAT, true, float64(7)},
+		{int64(1 << 53), FIELD_TYPE_FLOAT, true, float64(1 << 53)},
+		{int64(-1 << 53), FIELD_TYPE_FLOAT, true, float64(-1 << 53)},
+		{int64(1<<53 + 1), FIELD_TYPE_FLOAT, false, nil},
+		{int64(-1<<53 - 1), FIELD_TYPE_FLOAT, false, nil},
+		{"9007199254740993", FIELD_TYPE_FLOAT, false, nil},
+		{"99999999999999999999", FIELD_TYPE_FLOAT, false, nil},
+		{"0.5", FIELD_TYPE_FLOAT, true, 0.5},
+		{"1e30", FIELD_TYPE_FLOAT, true, 1e30},
+		{"abc", FIELD_TYPE_FLOAT, false, nil},
+		{true, FIELD_TYPE_FLOAT, false, nil},
+		{4.0, FIELD_TYPE_INTEGER, true, int64(4)},
+		{4.5, FIELD_TYPE_INTEGER, false, nil},
+		{"42", FIELD_TYPE_INTEGER, true, int64(42)},
+		{"true", FIELD_TYPE_BOOLEAN, true, true},
+		{int64(1), FIELD_TYPE_BOOLEAN, false, nil},
+		{int64(1), FIELD_TYPE_STRING, true, "1"},
+		{uint64(5), FIELD_TYPE_FLOAT, true, float64(5)},
+		{uint64(math.MaxUint64), FIELD_TYPE_FLOAT, false, nil},
+		{uint64(math.MaxUint64), FIELD_TYPE_INTEGER, false, nil},
+	}
+	for _, test := range tests {
+		c, ok := coerceField(test.v, test.typ)
+		if ok != test.ok {
+			t.Errorf("coercing %#v to %s: got ok %t, want %t", test.v, test.typ, ok, test.ok)
+			continue
+		}
+		if ok && c != test.c {
+			t.Errorf("coercing %#v to %s: got %#v, want %#v", test.v, test.typ, c, test.c)
+		}
+	}
+}
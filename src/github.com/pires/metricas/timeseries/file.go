@@ -0,0 +1,101 @@
+package timeseries
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	SINK_FILE = "file"
+)
+
+type FileConfiguration struct {
+	Path string // points are appended to this file
+	// one of n, u, ms, s, m or h, defaults to nanoseconds
+	Precision string
+}
+
+func init() {
+	RegisterSink(SINK_FILE, func(config *SinkConfiguration) (Sink, error) {
+		if config.File == nil {
+			return nil, errors.New("missing file sink configuration")
+		}
+		return NewFileSink(config.File)
+	})
+}
+
+// Archives points to a file in InfluxDB line protocol, so that they can be
+// replayed into InfluxDB later on
+type fileSink struct {
+	mu        sync.Mutex
+	file      *os.File
+	w         *bufio.Writer
+	lineProto *lineProtocol
+	written   uint64 // updated atomically
+}
+
+func NewFileSink(config *FileConfiguration) (Sink, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{
+		file:      f,
+		w:         bufio.NewWriter(f),
+		lineProto: newLineProtocol(config.Precision, 256),
+	}, nil
+}
+
+func (config *FileConfiguration) validate() error {
+	if config.Path == "" {
+		return errors.New("missing file sink path")
+	}
+	switch config.Precision {
+	case "", "n", "u", "ms", "s", "m", "h":
+		return nil
+	}
+	return fmt.Errorf("invalid precision %q, must be one of n, u, ms, s, m or h", config.Precision)
+}
+
+func (fs *fileSink) Write(point *Point) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.lineProto.reset()
+	if err := fs.lineProto.append(point); err != nil {
+		return err
+	}
+	if _, err := fs.w.Write(fs.lineProto.buf); err != nil {
+		return err
+	}
+	atomic.AddUint64(&fs.written, 1)
+	return nil
+}
+
+func (fs *fileSink) Flush() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.w.Flush()
+}
+
+func (fs *fileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.w.Flush(); err != nil {
+		fs.file.Close()
+		return err
+	}
+	return fs.file.Close()
+}
+
+func (fs *fileSink) Stats() Stats {
+	return Stats{
+		Written: atomic.LoadUint64(&fs.written),
+	}
+}
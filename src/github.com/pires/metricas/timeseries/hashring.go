@@ -0,0 +1,100 @@
+package timeseries
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+const (
+	HASH_RING_VIRTUAL_NODES = 160 // virtual nodes per node
+)
+
+// A consistent hash ring. Every node is placed on the ring several times, as
+// virtual nodes, and a key belongs to the first node found walking the ring
+// clockwise from the key's hash. Adding a node to a ring of n nodes moves
+// roughly 1/(n+1) of the keys, all of them to the new node.
+type HashRing struct {
+	nodes  []string
+	hashes []uint64 // sorted
+	owners []int    // owners[i] is the node placed at hashes[i]
+}
+
+// Places every node on the ring vnodes times, HASH_RING_VIRTUAL_NODES when
+// zero. Node names must be stable, since they decide where nodes are placed.
+func NewHashRing(nodes []string, vnodes int) *HashRing {
+	if vnodes <= 0 {
+		vnodes = HASH_RING_VIRTUAL_NODES
+	}
+	r := &HashRing{
+		nodes:  nodes,
+		hashes: make([]uint64, 0, len(nodes)*vnodes),
+		owners: make([]int, 0, len(nodes)*vnodes),
+	}
+	for i, node := range nodes {
+		for v := 0; v < vnodes; v++ {
+			r.hashes = append(r.hashes, hashKey(node+"#"+strconv.Itoa(v)))
+			r.owners = append(r.owners, i)
+		}
+	}
+	sort.Sort((*vnodesByHash)(r))
+	return r
+}
+
+// Orders the virtual nodes of a ring by hash
+type vnodesByHash HashRing
+
+func (r *vnodesByHash) Len() int           { return len(r.hashes) }
+func (r *vnodesByHash) Less(i, j int) bool { return r.hashes[i] < r.hashes[j] }
+func (r *vnodesByHash) Swap(i, j int) {
+	r.hashes[i], r.hashes[j] = r.hashes[j], r.hashes[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+
+// Returns the indexes of the n distinct nodes owning key, the first one being
+// its primary owner
+func (r *HashRing) Lookup(key string, n int) []int {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	owners := make([]int, 0, n)
+	if n == 0 {
+		return owners
+	}
+	h := hashKey(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	for i := 0; len(owners) < n; i++ {
+		owner := r.owners[(start+i)%len(r.owners)]
+		if !containsInt(owners, owner) {
+			owners = append(owners, owner)
+		}
+	}
+	return owners
+}
+
+// Returns the names of the n distinct nodes owning key
+func (r *HashRing) Get(key string, n int) []string {
+	owners := r.Lookup(key, n)
+	names := make([]string, len(owners))
+	for i, owner := range owners {
+		names[i] = r.nodes[owner]
+	}
+	return names
+}
+
+// MD5 spreads similar keys, like the names of virtual nodes, evenly on the
+// ring, which cheaper hashes like FNV do not
+func hashKey(key string) uint64 {
+	sum := md5.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func containsInt(s []int, v int) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
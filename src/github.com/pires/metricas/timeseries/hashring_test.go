@@ -0,0 +1,113 @@
+package timeseries
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ringKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("cpu,host=server-%d,region=eu", i)
+	}
+	return keys
+}
+
+func ringNodes(n int) []string {
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("influxdb-%d:8086", i)
+	}
+	return nodes
+}
+
+func TestHashRingMovement(t *testing.T) {
+	keys := ringKeys(20000)
+	tests := []struct {
+		from, to int // nodes before and after
+	}{
+		{1, 2},
+		{2, 3},
+		{3, 4},
+		{4, 5},
+		{7, 8},
+		{5, 4},
+		{3, 2},
+	}
+	for _, test := range tests {
+		before, after := NewHashRing(ringNodes(test.from), 0), NewHashRing(ringNodes(test.to), 0)
+		larger := test.to
+		if test.from > larger {
+			larger = test.from
+		}
+		// the node added or removed, the last one
+		changed := ringNodes(larger)[larger-1]
+		var moved int
+		for _, key := range keys {
+			from, to := before.Get(key, 1)[0], after.Get(key, 1)[0]
+			if from == to {
+				continue
+			}
+			moved++
+			if test.to > test.from && to != changed {
+				t.Errorf("%d to %d nodes: %s moved from %s to %s, not to the added node", test.from, test.to, key, from, to)
+			}
+			if test.to < test.from && from != changed {
+				t.Errorf("%d to %d nodes: %s moved from %s to %s, not from the removed node", test.from, test.to, key, from, to)
+			}
+		}
+		// ideally 1/n of the keys, n being the larger number of nodes
+		ideal := float64(len(keys)) / float64(larger)
+		if float64(moved) < 0.75*ideal || float64(moved) > 1.25*ideal {
+			t.Errorf("%d to %d nodes: %d of %d keys moved, want about %.0f", test.from, test.to, moved, len(keys), ideal)
+		}
+	}
+}
+
+func TestHashRingBalance(t *testing.T) {
+	keys := ringKeys(20000)
+	for _, n := range []int{2, 3, 5, 8} {
+		ring := NewHashRing(ringNodes(n), 0)
+		counts := make(map[string]int)
+		for _, key := range keys {
+			counts[ring.Get(key, 1)[0]]++
+		}
+		ideal := float64(len(keys)) / float64(n)
+		for node, count := range counts {
+			if float64(count) < 0.75*ideal || float64(count) > 1.25*ideal {
+				t.Errorf("%d nodes: %s owns %d of %d keys, want about %.0f", n, node, count, len(keys), ideal)
+			}
+		}
+	}
+}
+
+func TestHashRingReplicas(t *testing.T) {
+	ring := NewHashRing(ringNodes(3), 0)
+	tests := []struct {
+		n, owners int
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{3, 3},
+		{5, 3},
+	}
+	for _, test := range tests {
+		for _, key := range ringKeys(100) {
+			owners := ring.Get(key, test.n)
+			if len(owners) != test.owners {
+				t.Fatalf("%d replicas of %s: got owners %v, want %d", test.n, key, owners, test.owners)
+			}
+			seen := make(map[string]bool)
+			for _, owner := range owners {
+				if seen[owner] {
+					t.Fatalf("%d replicas of %s: %s owns it twice in %v", test.n, key, owner, owners)
+				}
+				seen[owner] = true
+			}
+			if test.n > 0 && owners[0] != ring.Get(key, 1)[0] {
+				t.Fatalf("%d replicas of %s: primary owner %s, want %s", test.n, key, owners[0], ring.Get(key, 1)[0])
+			}
+		}
+	}
+}
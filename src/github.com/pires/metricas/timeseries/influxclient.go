@@ -0,0 +1,224 @@
+package timeseries
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	influxdb "github.com/influxdb/influxdb/client"
+)
+
+// Column of the rows returned by influxClient.Rows holding the series name
+const SERIES_COLUMN = "_series"
+
+// Error answered by InfluxDB to a request
+type influxError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *influxError) Error() string {
+	return e.Message
+}
+
+// Whether InfluxDB refused the points written themselves, e.g. because they
+// could not be parsed or the batch is too large, so that writing them again
+// would fail again
+func isRejected(err error) bool {
+	e, ok := err.(*influxError)
+	return ok && (e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusRequestEntityTooLarge)
+}
+
+// Talks to the InfluxDB HTTP API. The InfluxDB client does not let its HTTP
+// transport be configured, so only its types are used.
+type influxClient struct {
+	url       url.URL
+	user      string
+	password  string
+	userAgent string
+	http      *http.Client
+}
+
+func newInfluxClient(config *InfluxDBConfiguration) (*influxClient, error) {
+	scheme := "http"
+	if config.HTTPS {
+		scheme = "https"
+	}
+	u, err := url.Parse(scheme + "://" + config.AddrInfluxDb)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableKeepAlives:   config.DisableKeepAlives,
+		MaxIdleConns:        config.MaxIdleConns,
+		MaxIdleConnsPerHost: config.MaxIdleConns,
+		IdleConnTimeout:     config.IdleConnTimeout,
+	}
+	return &influxClient{
+		url:       *u,
+		user:      config.DbUser,
+		password:  config.DbPwd,
+		userAgent: config.UserAgent,
+		http:      &http.Client{Transport: transport, Timeout: config.Timeout},
+	}, nil
+}
+
+// Returns the TLS configuration of HTTPS connections, nil for HTTP
+func (config *InfluxDBConfiguration) tlsConfig() (*tls.Config, error) {
+	if !config.HTTPS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CACert != "" {
+		pem, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACert)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Checks InfluxDB answers, returning its version
+func (c *influxClient) Ping() (string, error) {
+	resp, err := c.do("GET", "ping", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("received status code %d from server", resp.StatusCode)
+	}
+	return resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+// Writes points in line protocol
+func (c *influxClient) Write(data, db, rp, precision, consistency string) error {
+	params := url.Values{}
+	params.Set("db", db)
+	params.Set("rp", rp)
+	params.Set("precision", precision)
+	params.Set("consistency", consistency)
+	resp, err := c.do("POST", "write", params, strings.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		// newer versions answer errors as JSON
+		var e struct {
+			Error string `json:"error"`
+		}
+		message := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			message = e.Error
+		}
+		if message == "" {
+			message = fmt.Sprintf("received status code %d from server", resp.StatusCode)
+		}
+		return &influxError{StatusCode: resp.StatusCode, Message: message}
+	}
+	return nil
+}
+
+// Runs a query, returning the error of the first statement that failed, if any
+func (c *influxClient) Query(command, db string) (*influxdb.Response, error) {
+	params := url.Values{}
+	params.Set("q", command)
+	params.Set("db", db)
+	// InfluxDB only accepts statements other than SELECT and SHOW over POST
+	resp, err := c.do("POST", "query", params, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var response influxdb.Response
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&response); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("received status code %d from server", resp.StatusCode)
+		}
+		return nil, err
+	}
+	if err := response.Error(); err != nil {
+		return &response, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &response, fmt.Errorf("received status code %d from server", resp.StatusCode)
+	}
+	return &response, nil
+}
+
+// Runs a query, returning the rows of every series of its first statement as
+// values by column, along with the name of their series
+func (c *influxClient) Rows(command, db string) ([]map[string]interface{}, error) {
+	response, err := c.Query(command, db)
+	if err != nil {
+		return nil, err
+	}
+	var rows []map[string]interface{}
+	if len(response.Results) == 0 {
+		return rows, nil
+	}
+	for _, series := range response.Results[0].Series {
+		for _, values := range series.Values {
+			row := make(map[string]interface{}, len(series.Columns)+1)
+			for i, column := range series.Columns {
+				if i < len(values) {
+					row[column] = values[i]
+				}
+			}
+			row[SERIES_COLUMN] = series.Name
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// Quotes an identifier, e.g. a database name, for InfluxQL
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(strings.Replace(name, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func (c *influxClient) do(method, path string, params url.Values, body io.Reader) (*http.Response, error) {
+	u := c.url
+	u.Path = path
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	return c.http.Do(req)
+}
@@ -0,0 +1,805 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	influxdb "github.com/influxdb/influxdb/client"
+
+	"github.com/pires/metricas/instrument"
+)
+
+const (
+	SINK_INFLUXDB = "influxdb"
+
+	FLUSH_INTERVAL_MS        = 5000      // flush every 5 seconds
+	FLUSH_MAX_POINTS         = 1024      // or flush when we reach 1024 points
+	DEFAULT_RETENTION_POLICY = "default" // InfluxDB default retention policy
+	RETRY_BACKOFF_MS         = 1000      // wait a second before retrying a failed write
+	RETRY_MAX_BACKOFF_MS     = 30000     // doubling the wait up to 30 seconds
+	REQUEST_TIMEOUT_MS       = 30000     // give up on requests to InfluxDB after 30 seconds
+	MAX_IDLE_CONNS           = 4         // idle connections kept open to InfluxDB
+	IDLE_CONN_TIMEOUT_MS     = 90000     // closing them after a minute and a half
+	STARTUP_PING_INTERVAL_MS = 1000      // how often InfluxDB is pinged while waiting for it at startup
+	USER_AGENT               = "metricas"
+
+	WRITE_PROTOCOL_LINE  = "line"  // points serialized directly into line protocol
+	WRITE_PROTOCOL_BATCH = "batch" // points handed to the InfluxDB client as BatchPoints
+)
+
+type InfluxDBConfiguration struct {
+	AddrInfluxDb string
+	DbUser       string
+	DbPwd        string
+	DbName       string
+	// batching, defaults to FLUSH_INTERVAL_MS and FLUSH_MAX_POINTS when zero
+	FlushInterval  time.Duration
+	FlushMaxPoints int
+	// retention policy to write to, defaults to DEFAULT_RETENTION_POLICY
+	RetentionPolicy string
+	// per-measurement retention policy overrides
+	RetentionPolicies map[string]string
+	// one of n, u, ms, s, m or h, defaults to nanoseconds
+	Precision string
+	// one of any, one, quorum or all, defaults to the server setting
+	WriteConsistency string
+	// one of WRITE_PROTOCOL_LINE or WRITE_PROTOCOL_BATCH, defaults to the former
+	WriteProtocol string
+	// times a failed write is retried before its points are discarded, waiting
+	// RetryBackoff (RETRY_BACKOFF_MS when zero) before the first retry
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// connects over HTTPS, verifying the server certificate against CACert,
+	// a PEM file, or the system CAs, unless InsecureSkipVerify
+	HTTPS              bool
+	CACert             string
+	InsecureSkipVerify bool
+	// requests taking longer fail, defaults to REQUEST_TIMEOUT_MS
+	Timeout time.Duration
+	// defaults to USER_AGENT
+	UserAgent string
+	// connection reuse, defaults to MAX_IDLE_CONNS connections idle for up
+	// to IDLE_CONN_TIMEOUT_MS
+	DisableKeepAlives bool
+	MaxIdleConns      int
+	IdleConnTimeout   time.Duration
+	// how long to wait for InfluxDB to answer when the sink is created,
+	// failing right away when zero and waiting forever when negative
+	StartupWait time.Duration
+	// tag naming the database points are written to instead of DbName, e.g.
+	// that of their tenant, removed from the points
+	DatabaseTag string
+	// creates the database and retention policies when missing, and alters
+	// policies that differ, when the sink is created and for databases of
+	// DatabaseTag when their first points are written
+	Provision *ProvisionConfiguration
+	// checks points against the field types InfluxDB stores before writing
+	// them, coercing or quarantining conflicting points, one of
+	// FIELD_CONFLICTS_COERCE or FIELD_CONFLICTS_QUARANTINE, disabled when empty
+	FieldConflicts string
+	// where points InfluxDB rejects, or would reject, are set aside, they are
+	// discarded when nil
+	Quarantine *QuarantineConfiguration
+	// opens a circuit breaker after BreakerThreshold consecutive failed
+	// writes, holding points instead of writing them until InfluxDB answers
+	// a ping after BreakerCooldown (BREAKER_COOLDOWN_MS when zero) and a write
+	// succeeds again, disabled when zero
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// adapts writes to keep them under this latency, from FlushMaxPoints
+	// points down to ADAPTIVE_RANGE times fewer, flushing buffered points in
+	// several writes, and from every FlushInterval down to ADAPTIVE_RANGE
+	// times less often when fewer than FlushMaxPoints are buffered, disabled
+	// when zero
+	AdaptiveLatency time.Duration
+}
+
+func init() {
+	RegisterSink(SINK_INFLUXDB, func(config *SinkConfiguration) (Sink, error) {
+		if config.InfluxDB == nil {
+			return nil, errors.New("missing InfluxDB sink configuration")
+		}
+		return NewInfluxDBSink(config.InfluxDB)
+	})
+}
+
+type influxDbSink struct {
+	config    *InfluxDBConfiguration
+	db        *influxClient
+	pointsBuf []Point
+	lineProto *lineProtocol
+	// databases written to so far, provisioned when configured to
+	databases map[string]bool
+	// field types checked before writing, by database, nil when disabled
+	fieldTypes map[string]*fieldTypes
+	quarantine *quarantine
+	// nil when disabled
+	breaker  *breaker
+	adaptive *adaptiveBatching
+	buffered int64        // updated atomically
+	oldest   int64        // when the first buffered point was written, in Unix nanoseconds, updated atomically
+	reporter atomic.Value // func(error), see ReportErrors
+	// instrumentation
+	written       *instrument.Counter
+	failed        *instrument.Counter
+	writeErrors   *instrument.Counter
+	retries       *instrument.Counter
+	flushSize     *instrument.Histogram
+	flushLatency  *instrument.Histogram
+	coerced       *instrument.Counter
+	quarantined   *instrument.Counter
+	noFields      *instrument.Counter
+	invalidFields *instrument.Counter
+	breakerOpen   *instrument.Counter
+	// channels
+	pointsChan chan *Point
+	flushChan  chan chan error
+	pauseChan  chan bool
+	stop       chan struct{}
+	done       chan error
+}
+
+func NewInfluxDBSink(config *InfluxDBConfiguration) (Sink, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := newInfluxClient(config)
+	if err != nil {
+		return nil, err
+	}
+	// we may have connected, but let's ping
+	if err := waitForInfluxDB(client, config); err != nil {
+		return nil, err
+	}
+	if config.Provision != nil {
+		if err := provision(client, config.DbName, config.Provision); err != nil {
+			return nil, err
+		}
+	}
+	var q *quarantine
+	if config.Quarantine != nil {
+		if q, err = newQuarantine(config.Quarantine, config.Precision); err != nil {
+			return nil, err
+		}
+	}
+	// we're good to go
+	ts := &influxDbSink{
+		config:     config,
+		db:         client,
+		databases:  map[string]bool{config.DbName: true},
+		quarantine: q,
+		pointsBuf:  make([]Point, 0, config.FlushMaxPoints),
+		lineProto:  newLineProtocol(config.Precision, 64*config.FlushMaxPoints),
+		pointsChan: make(chan *Point),
+		flushChan:  make(chan chan error),
+		pauseChan:  make(chan bool),
+		stop:       make(chan struct{}),
+		done:       make(chan error, 1),
+	}
+	if config.BreakerThreshold > 0 {
+		ts.breaker = &breaker{
+			addr:      config.AddrInfluxDb,
+			threshold: config.BreakerThreshold,
+			cooldown:  config.BreakerCooldown,
+		}
+	}
+	if config.AdaptiveLatency > 0 {
+		ts.adaptive = newAdaptiveBatching(config.AdaptiveLatency, config.FlushMaxPoints, config.FlushInterval)
+	}
+	if config.FieldConflicts != "" {
+		ts.fieldTypes = make(map[string]*fieldTypes)
+		ts.seedFieldTypes(config.DbName)
+	}
+	ts.instrument(instrument.Default)
+
+	// handle incoming metrics
+	go ts.run()
+
+	return ts, nil
+}
+
+// Checks write options and fills in defaults for the ones left empty
+func (config *InfluxDBConfiguration) validate() error {
+	if config.AddrInfluxDb == "" {
+		return errors.New("missing InfluxDB address")
+	}
+	// points without DatabaseTag are written to it
+	if config.DbName == "" {
+		return errors.New("missing database name")
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = FLUSH_INTERVAL_MS * time.Millisecond
+	}
+	if config.FlushMaxPoints <= 0 {
+		config.FlushMaxPoints = FLUSH_MAX_POINTS
+	}
+	if config.RetentionPolicy == "" {
+		config.RetentionPolicy = DEFAULT_RETENTION_POLICY
+	}
+	if config.BreakerThreshold < 0 {
+		return fmt.Errorf("invalid breaker threshold %d, must not be negative", config.BreakerThreshold)
+	}
+	if config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = BREAKER_COOLDOWN_MS * time.Millisecond
+	}
+	if config.AdaptiveLatency < 0 {
+		return fmt.Errorf("invalid adaptive latency %s, must not be negative", config.AdaptiveLatency)
+	}
+	if config.MaxRetries < 0 {
+		return fmt.Errorf("invalid max retries %d, must not be negative", config.MaxRetries)
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = RETRY_BACKOFF_MS * time.Millisecond
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = REQUEST_TIMEOUT_MS * time.Millisecond
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = USER_AGENT
+	}
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = MAX_IDLE_CONNS
+	}
+	if config.IdleConnTimeout <= 0 {
+		config.IdleConnTimeout = IDLE_CONN_TIMEOUT_MS * time.Millisecond
+	}
+	if !config.HTTPS && (config.CACert != "" || config.InsecureSkipVerify) {
+		return errors.New("CA certificate and skipping verification require HTTPS")
+	}
+	if _, err := config.tlsConfig(); err != nil {
+		return err
+	}
+	if config.Provision != nil {
+		if err := config.Provision.validate(config.RetentionPolicy); err != nil {
+			return err
+		}
+	}
+	switch config.Precision {
+	case "", "n", "u", "ms", "s", "m", "h":
+	default:
+		return fmt.Errorf("invalid precision %q, must be one of n, u, ms, s, m or h", config.Precision)
+	}
+	switch config.FieldConflicts {
+	case "", FIELD_CONFLICTS_COERCE, FIELD_CONFLICTS_QUARANTINE:
+	default:
+		return fmt.Errorf("invalid field conflict policy %q, must be one of coerce or quarantine", config.FieldConflicts)
+	}
+	if config.Quarantine != nil {
+		if err := config.Quarantine.validate(); err != nil {
+			return err
+		}
+	}
+	switch config.WriteConsistency {
+	case "", influxdb.ConsistencyAny, influxdb.ConsistencyOne, influxdb.ConsistencyQuorum, influxdb.ConsistencyAll:
+	default:
+		return fmt.Errorf("invalid write consistency %q, must be one of any, one, quorum or all", config.WriteConsistency)
+	}
+	switch config.WriteProtocol {
+	case "":
+		config.WriteProtocol = WRITE_PROTOCOL_LINE
+	case WRITE_PROTOCOL_LINE, WRITE_PROTOCOL_BATCH:
+	default:
+		return fmt.Errorf("invalid write protocol %q, must be one of line or batch", config.WriteProtocol)
+	}
+	return nil
+}
+
+// Returns the retention policy points of the given measurement are written to
+func (config *InfluxDBConfiguration) retentionPolicy(measurement string) string {
+	if rp, ok := config.RetentionPolicies[measurement]; ok {
+		return rp
+	}
+	return config.RetentionPolicy
+}
+
+// Returns the database a point is written to
+func (config *InfluxDBConfiguration) database(point *Point) string {
+	if point.Database != "" {
+		return point.Database
+	}
+	return config.DbName
+}
+
+// Returns the point to buffer, with the database of its DatabaseTag, if any,
+// instead of the tag
+func (config *InfluxDBConfiguration) route(point *Point) Point {
+	p := *point
+	db, ok := p.Tags[config.DatabaseTag]
+	if config.DatabaseTag == "" || !ok {
+		return p
+	}
+	// tags may be shared with other sinks
+	p.Tags = make(map[string]string, len(point.Tags)-1)
+	for k, v := range point.Tags {
+		if k != config.DatabaseTag {
+			p.Tags[k] = v
+		}
+	}
+	if db != "" {
+		p.Database = db
+	}
+	return p
+}
+
+func (ts *influxDbSink) Write(point *Point) error {
+	select {
+	case ts.pointsChan <- point:
+		return nil
+	case <-ts.stop:
+		return ErrSinkClosed
+	}
+}
+
+func (ts *influxDbSink) Flush() error {
+	result := make(chan error, 1)
+	select {
+	case ts.flushChan <- result:
+		return <-result
+	case <-ts.stop:
+		return ErrSinkClosed
+	}
+}
+
+func (ts *influxDbSink) Close() error {
+	close(ts.stop)
+	return <-ts.done
+}
+
+// Stops flushing buffered points, until resumed
+func (ts *influxDbSink) Pause() {
+	ts.setPaused(true)
+}
+
+func (ts *influxDbSink) Resume() {
+	ts.setPaused(false)
+}
+
+func (ts *influxDbSink) setPaused(paused bool) {
+	select {
+	case ts.pauseChan <- paused:
+	case <-ts.stop:
+	}
+}
+
+func (ts *influxDbSink) Stats() Stats {
+	stats := Stats{
+		Written:  ts.written.Value(),
+		Failed:   ts.failed.Value(),
+		Retries:  ts.retries.Value(),
+		Dropped:  ts.quarantined.Value() + ts.noFields.Value() + ts.invalidFields.Value(),
+		Buffered: uint64(atomic.LoadInt64(&ts.buffered)),
+	}
+	if oldest := atomic.LoadInt64(&ts.oldest); oldest > 0 {
+		stats.OldestBuffered = time.Unix(0, oldest)
+	}
+	return stats
+}
+
+func (ts *influxDbSink) ReportErrors(report func(error)) {
+	ts.reporter.Store(report)
+}
+
+// Reports an error of the goroutine of the sink if asked to, logging it
+// otherwise
+func (ts *influxDbSink) reportError(err error) {
+	if !ts.report(err) {
+		log.Println(err)
+	}
+}
+
+// Reports an error if asked to
+func (ts *influxDbSink) report(err error) bool {
+	report, ok := ts.reporter.Load().(func(error))
+	if ok {
+		report(err)
+	}
+	return ok
+}
+
+func (ts *influxDbSink) Ping() error {
+	_, err := ts.db.Ping()
+	return err
+}
+
+// Pings InfluxDB until it answers, for up to config.StartupWait
+func waitForInfluxDB(client *influxClient, config *InfluxDBConfiguration) error {
+	deadline := time.Now().Add(config.StartupWait)
+	for {
+		_, err := client.Ping()
+		if err == nil || config.StartupWait == 0 {
+			return err
+		}
+		if config.StartupWait > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("InfluxDB %s did not answer within %s: %s", config.AddrInfluxDb, config.StartupWait, err)
+		}
+		log.Printf("Waiting for InfluxDB %s: %s", config.AddrInfluxDb, err)
+		time.Sleep(STARTUP_PING_INTERVAL_MS * time.Millisecond)
+	}
+}
+
+// Tags of the sink's instrumentation
+func (ts *influxDbSink) instrumentTags() map[string]string {
+	return map[string]string{"addr": ts.config.AddrInfluxDb, "db": ts.config.DbName}
+}
+
+// Registers the sink's counters, measured as metricas_influxdb, until it is
+// closed. A sink replacing it on reload keeps counting from where it stopped.
+func (ts *influxDbSink) instrument(r *instrument.Registry) {
+	tags := ts.instrumentTags()
+	r.Claim("metricas_influxdb", tags, ts)
+	ts.written = r.Counter("metricas_influxdb", tags, "points_written")
+	ts.failed = r.Counter("metricas_influxdb", tags, "points_failed")
+	ts.writeErrors = r.Counter("metricas_influxdb", tags, "write_errors")
+	ts.retries = r.Counter("metricas_influxdb", tags, "retries")
+	ts.flushSize = r.Histogram("metricas_influxdb", tags, "flush_size")
+	ts.flushLatency = r.Histogram("metricas_influxdb", tags, "flush_latency_ms")
+	ts.coerced = r.Counter("metricas_influxdb", tags, "points_coerced")
+	ts.quarantined = r.Counter("metricas_influxdb", tags, "points_quarantined")
+	ts.noFields = r.Counter("metricas_influxdb", tags, "points_without_fields")
+	ts.invalidFields = r.Counter("metricas_influxdb", tags, "points_with_invalid_fields")
+	ts.breakerOpen = r.Counter("metricas_influxdb", tags, "breaker_opened")
+	r.Gauge("metricas_influxdb", tags, "points_buffered", func() int64 {
+		return atomic.LoadInt64(&ts.buffered)
+	})
+	r.Gauge("metricas_influxdb", tags, "breaker_state", func() int64 {
+		if ts.breaker == nil {
+			return BREAKER_CLOSED
+		}
+		return atomic.LoadInt64(&ts.breaker.state)
+	})
+	r.Gauge("metricas_influxdb", tags, "batch_size", func() int64 {
+		return int64(ts.batchSize())
+	})
+	r.Gauge("metricas_influxdb", tags, "flush_interval_ms", func() int64 {
+		return int64(ts.flushInterval() / time.Millisecond)
+	})
+}
+
+// Points written at once, as adapted to the latency of writes
+func (ts *influxDbSink) batchSize() int {
+	if ts.adaptive == nil {
+		return ts.config.FlushMaxPoints
+	}
+	return ts.adaptive.batchSize()
+}
+
+// Time between flushes, as adapted to the latency of writes
+func (ts *influxDbSink) flushInterval() time.Duration {
+	if ts.adaptive == nil {
+		return ts.config.FlushInterval
+	}
+	return ts.adaptive.flushInterval()
+}
+
+func (ts *influxDbSink) breakerOpened() bool {
+	return ts.breaker != nil && ts.breaker.isOpen()
+}
+
+// Whether the sink is being closed, writing what it buffered one last time
+func (ts *influxDbSink) stopping() bool {
+	select {
+	case <-ts.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Handles incoming metrics in batches
+// TODO implement pool of flushers
+func (ts *influxDbSink) run() {
+	flushTimeout := time.NewTimer(ts.flushInterval())
+	paused := false
+	for {
+		held := paused || ts.breakerOpened()
+		pointsChan := ts.pointsChan
+		if held && len(ts.pointsBuf) >= ts.config.FlushMaxPoints {
+			// hold writers back until resumed, or InfluxDB recovers
+			pointsChan = nil
+		}
+		select {
+		case <-ts.stop:
+			flushTimeout.Stop()
+			err := ts.flush()
+			if ts.quarantine != nil {
+				if qerr := ts.quarantine.close(); err == nil {
+					err = qerr
+				}
+			}
+			// the gauges would keep the sink from being collected
+			instrument.Default.Release("metricas_influxdb", ts.instrumentTags(), ts)
+			ts.done <- err
+			return
+		case point := <-pointsChan:
+			if len(ts.pointsBuf) == 0 {
+				atomic.StoreInt64(&ts.oldest, time.Now().UnixNano())
+			}
+			ts.pointsBuf = append(ts.pointsBuf, ts.config.route(point))
+			atomic.StoreInt64(&ts.buffered, int64(len(ts.pointsBuf)))
+			// flushes stay as frequent when batches shrink, written in
+			// several smaller writes instead
+			if len(ts.pointsBuf) >= ts.config.FlushMaxPoints && !held {
+				ts.flush()
+			}
+		case result := <-ts.flushChan:
+			result <- ts.flush()
+		case paused = <-ts.pauseChan:
+			if len(ts.pointsBuf) >= ts.config.FlushMaxPoints && !paused && !ts.breakerOpened() {
+				ts.flush()
+			}
+		case <-flushTimeout.C:
+			if ts.breaker != nil && ts.breaker.cooledDown(time.Now()) {
+				_, err := ts.db.Ping()
+				ts.breaker.probed(time.Now(), err)
+			}
+			// is there anything to flush?
+			if len(ts.pointsBuf) > 0 && !paused && !ts.breakerOpened() {
+				ts.flush()
+			}
+			next := ts.flushInterval()
+			if ts.breakerOpened() && ts.breaker.cooldown < next {
+				next = ts.breaker.cooldown
+			}
+			flushTimeout.Reset(next)
+		}
+	}
+}
+
+// Where a batch is written to
+type destination struct {
+	db string
+	rp string
+}
+
+// Writes buffered points to InfluxDB, in batches of a database and retention
+// policy each, holding them while the circuit breaker is open
+func (ts *influxDbSink) flush() error {
+	if ts.breakerOpened() && !ts.stopping() {
+		return errBreakerOpen
+	}
+	for i := range ts.pointsBuf {
+		if db := ts.config.database(&ts.pointsBuf[i]); !ts.databases[db] {
+			ts.addDatabase(db)
+		}
+	}
+	if ts.fieldTypes != nil {
+		ts.checkFieldTypes()
+	}
+	batches := make(map[destination][]Point)
+	for _, point := range ts.pointsBuf {
+		// skip points that cannot be written in line protocol
+		switch checkPoint(&point) {
+		case ErrNoFields:
+			ts.noFields.Inc()
+			continue
+		case ErrInvalidField:
+			ts.invalidFields.Inc()
+			continue
+		}
+		dest := destination{db: ts.config.database(&point), rp: point.RetentionPolicy}
+		if dest.rp == "" {
+			dest.rp = ts.config.retentionPolicy(point.Measurement)
+		}
+		batches[dest] = append(batches[dest], point)
+	}
+	var lastErr error
+	var held []Point
+	for dest, points := range batches {
+		for len(points) > 0 {
+			n := ts.batchSize()
+			if n > len(points) {
+				n = len(points)
+			}
+			ts.flushSize.Observe(float64(n))
+			h, err := ts.writeBatch(points[:n], dest)
+			if err != nil {
+				lastErr = err
+			}
+			held = append(held, h...)
+			points = points[n:]
+		}
+	}
+	// empty buffer but for held points, keeping its capacity
+	ts.pointsBuf = append(ts.pointsBuf[:0], held...)
+	atomic.StoreInt64(&ts.buffered, int64(len(ts.pointsBuf)))
+	if len(ts.pointsBuf) == 0 {
+		atomic.StoreInt64(&ts.oldest, 0)
+	}
+	return lastErr
+}
+
+// Provisions a database points are written to for the first time, when
+// configured to, and learns its field types. Provisioning is attempted again
+// on the next flush when it fails.
+func (ts *influxDbSink) addDatabase(db string) {
+	if ts.config.Provision != nil {
+		if err := provision(ts.db, db, ts.config.Provision); err != nil {
+			ts.reportError(fmt.Errorf("failed provisioning database %s of InfluxDB %s: %s", db, ts.config.AddrInfluxDb, err))
+			return
+		}
+	}
+	ts.databases[db] = true
+	if ts.fieldTypes != nil {
+		ts.seedFieldTypes(db)
+	}
+}
+
+// Reads the field types of a database, learning them from points instead
+// when InfluxDB does not answer
+func (ts *influxDbSink) seedFieldTypes(db string) {
+	ft := newFieldTypes(ts.config.FieldConflicts)
+	if err := ft.seed(ts.db, db); err != nil {
+		log.Printf("Could not read field types of database %s from InfluxDB %s, learning them from points instead: %s", db, ts.config.AddrInfluxDb, err)
+	}
+	ts.fieldTypes[db] = ft
+}
+
+// Writes a batch, isolating the points InfluxDB rejects from the others when
+// it rejects the batch. Returns the points held because the circuit breaker
+// is open.
+func (ts *influxDbSink) writeBatch(points []Point, dest destination) ([]Point, error) {
+	if ts.breakerOpened() && !ts.stopping() {
+		return points, errBreakerOpen
+	}
+	err := ts.writeWithRetries(points, dest)
+	if err == nil {
+		ts.written.Add(uint64(len(points)))
+		return nil, nil
+	}
+	if err == errBreakerOpen {
+		return points, err
+	}
+	if !isRejected(err) {
+		ts.reportError(fmt.Errorf("discarding %d points after failing to write them to InfluxDB %s: %s", len(points), ts.config.AddrInfluxDb, err))
+		ts.failed.Add(uint64(len(points)))
+		return nil, err
+	}
+
+	// the error may name the points, otherwise halves are written until the
+	// points rejected are found
+	rejected, kept, partial := ts.rejectedPoints(points, dest.db, err)
+	if len(rejected) > 0 {
+		ts.quarantinePoints(rejected, err)
+		if partial {
+			// InfluxDB wrote the others
+			ts.written.Add(uint64(len(kept)))
+			return nil, nil
+		}
+		if len(kept) == 0 {
+			return nil, nil
+		}
+		return ts.writeBatch(kept, dest)
+	}
+	if len(points) == 1 {
+		ts.quarantinePoints(points, err)
+		return nil, nil
+	}
+	half := len(points) / 2
+	held, err := ts.writeBatch(points[:half], dest)
+	rheld, rerr := ts.writeBatch(points[half:], dest)
+	if err == nil {
+		err = rerr
+	}
+	return append(held, rheld...), err
+}
+
+// Coerces or quarantines buffered points whose fields conflict with the types
+// InfluxDB stores, so that they do not fail the whole batch
+func (ts *influxDbSink) checkFieldTypes() {
+	kept := ts.pointsBuf[:0]
+	conflicts := make(map[string][]Point) // by error
+	for _, point := range ts.pointsBuf {
+		ft, ok := ts.fieldTypes[ts.config.database(&point)]
+		if !ok {
+			// provisioning failed, written regardless
+			kept = append(kept, point)
+			continue
+		}
+		p, coerced, err := ft.check(point)
+		if err != nil {
+			conflicts[err.Error()] = append(conflicts[err.Error()], point)
+			continue
+		}
+		if coerced {
+			ts.coerced.Inc()
+		}
+		kept = append(kept, p)
+	}
+	ts.pointsBuf = kept
+	for reason, points := range conflicts {
+		ts.quarantinePoints(points, errors.New(reason))
+	}
+}
+
+// Sets points InfluxDB rejects, or would reject, aside, if there is a
+// quarantine
+func (ts *influxDbSink) quarantinePoints(points []Point, reason error) {
+	ts.quarantined.Add(uint64(len(points)))
+	if ts.quarantine == nil {
+		ts.reportError(fmt.Errorf("discarding %d points rejected by InfluxDB %s: %s", len(points), ts.config.AddrInfluxDb, reason))
+		return
+	}
+	log.Printf("Quarantining %d points rejected by InfluxDB %s: %s", len(points), ts.config.AddrInfluxDb, reason)
+	if err := ts.quarantine.write(points, reason); err != nil {
+		ts.reportError(fmt.Errorf("failed quarantining points of InfluxDB %s: %s", ts.config.AddrInfluxDb, err))
+	}
+}
+
+// Writes a batch, retrying with exponential backoff on failure. Retrying
+// stops early when the sink is closed, or returns errBreakerOpen once failures
+// open the circuit breaker.
+func (ts *influxDbSink) writeWithRetries(points []Point, dest destination) error {
+	backoff := ts.config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		var err error
+		start := time.Now()
+		if ts.config.WriteProtocol == WRITE_PROTOCOL_BATCH {
+			err = ts.writeBatchPoints(points, dest)
+		} else {
+			err = ts.writeLineProtocol(points, dest)
+		}
+		latency := time.Since(start)
+		ts.flushLatency.Since(start)
+		if ts.adaptive != nil {
+			ts.adaptive.observe(latency)
+		}
+		// InfluxDB answered even when rejecting points
+		if err == nil || isRejected(err) {
+			if ts.breaker != nil {
+				ts.breaker.succeeded()
+			}
+			return err
+		}
+		ts.writeErrors.Inc()
+		if ts.breaker != nil && ts.breaker.failed(time.Now()) {
+			ts.breakerOpen.Inc()
+			ts.report(fmt.Errorf("InfluxDB %s is failing, holding points until it recovers: %s", ts.config.AddrInfluxDb, err))
+			if !ts.stopping() {
+				return errBreakerOpen
+			}
+		}
+		if attempt == ts.config.MaxRetries {
+			return err
+		}
+		log.Printf("Failed writing to InfluxDB %s, retrying in %s: %s", ts.config.AddrInfluxDb, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ts.stop:
+			return err
+		}
+		ts.retries.Inc()
+		if backoff *= 2; backoff > RETRY_MAX_BACKOFF_MS*time.Millisecond {
+			backoff = RETRY_MAX_BACKOFF_MS * time.Millisecond
+		}
+	}
+}
+
+// Serializes points into line protocol and writes them to InfluxDB
+func (ts *influxDbSink) writeLineProtocol(points []Point, dest destination) error {
+	ts.lineProto.reset()
+	for i := range points {
+		ts.lineProto.append(&points[i])
+	}
+	return ts.db.Write(ts.lineProto.String(), dest.db, dest.rp, ts.config.Precision, ts.config.WriteConsistency)
+}
+
+// Has the InfluxDB client serialize points, as it does for BatchPoints
+func (ts *influxDbSink) writeBatchPoints(points []Point, dest destination) error {
+	lines := make([]string, len(points))
+	for i, point := range points {
+		p := influxdb.Point{
+			Measurement: point.Measurement,
+			Tags:        point.Tags,
+			Fields:      point.Fields,
+			Time:        point.Time,
+			Precision:   ts.config.Precision,
+		}
+		lines[i] = p.MarshalString()
+	}
+	return ts.db.Write(strings.Join(lines, "\n")+"\n", dest.db, dest.rp, ts.config.Precision, ts.config.WriteConsistency)
+}
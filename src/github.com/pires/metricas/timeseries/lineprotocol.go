@@ -0,0 +1,193 @@
+package timeseries
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Serializes points into an InfluxDB line protocol buffer, e.g.
+//
+//	cpu,host=a,region=eu value=0.64,count=3i 1434055562000000000
+//
+// The buffer and the scratch space used to sort keys are reused across
+// points so that encoding a batch does not allocate once they have grown.
+type lineProtocol struct {
+	buf  []byte
+	keys []string
+	unit int64 // nanoseconds per timestamp unit
+}
+
+func newLineProtocol(precision string, size int) *lineProtocol {
+	return &lineProtocol{
+		buf:  make([]byte, 0, size),
+		unit: precisionUnit(precision),
+	}
+}
+
+// Appends a point, terminated by a new line, to the buffer. Points without
+// line protocol are skipped, returning why, see checkPoint.
+func (lp *lineProtocol) append(p *Point) error {
+	if err := checkPoint(p); err != nil {
+		return err
+	}
+	lp.buf = appendEscaped(lp.buf, p.Measurement, measurementEscapes)
+
+	// tags are sorted by key, as recommended by InfluxDB for performance
+	lp.keys = lp.keys[:0]
+	for k, v := range p.Tags {
+		// InfluxDB rejects empty tag values
+		if v != "" {
+			lp.keys = append(lp.keys, k)
+		}
+	}
+	sort.Strings(lp.keys)
+	for _, k := range lp.keys {
+		lp.buf = append(lp.buf, ',')
+		lp.buf = appendEscaped(lp.buf, k, keyEscapes)
+		lp.buf = append(lp.buf, '=')
+		lp.buf = appendEscaped(lp.buf, p.Tags[k], keyEscapes)
+	}
+
+	lp.buf = append(lp.buf, ' ')
+	lp.keys = lp.keys[:0]
+	for k := range p.Fields {
+		lp.keys = append(lp.keys, k)
+	}
+	sort.Strings(lp.keys)
+	for i, k := range lp.keys {
+		if i > 0 {
+			lp.buf = append(lp.buf, ',')
+		}
+		lp.buf = appendEscaped(lp.buf, k, keyEscapes)
+		lp.buf = append(lp.buf, '=')
+		lp.buf = appendFieldValue(lp.buf, p.Fields[k])
+	}
+
+	// let the server assign a timestamp if there is none
+	if !p.Time.IsZero() {
+		lp.buf = append(lp.buf, ' ')
+		lp.buf = strconv.AppendInt(lp.buf, p.Time.UnixNano()/lp.unit, 10)
+	}
+	lp.buf = append(lp.buf, '\n')
+	return nil
+}
+
+// Checks a point can be written in line protocol, which has no points without
+// fields, NaN or infinite floats, nor integers beyond the int64 range
+func checkPoint(p *Point) error {
+	if len(p.Fields) == 0 {
+		return ErrNoFields
+	}
+	for _, v := range p.Fields {
+		switch v := v.(type) {
+		case uint64:
+			if v > math.MaxInt64 {
+				return ErrInvalidField
+			}
+		case uint:
+			if uint64(v) > math.MaxInt64 {
+				return ErrInvalidField
+			}
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return ErrInvalidField
+			}
+		case float32:
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				return ErrInvalidField
+			}
+		}
+	}
+	return nil
+}
+
+func (lp *lineProtocol) reset() {
+	lp.buf = lp.buf[:0]
+}
+
+func (lp *lineProtocol) String() string {
+	return string(lp.buf)
+}
+
+const (
+	measurementEscapes = ", "
+	keyEscapes         = ",= "
+)
+
+// Appends s to buf, escaping any of the special characters with a backslash
+func appendEscaped(buf []byte, s string, special string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		for j := 0; j < len(special); j++ {
+			if c == special[j] {
+				buf = append(buf, '\\')
+				break
+			}
+		}
+		buf = append(buf, c)
+	}
+	return buf
+}
+
+func appendFieldValue(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case int64:
+		return append(strconv.AppendInt(buf, v, 10), 'i')
+	case int:
+		return append(strconv.AppendInt(buf, int64(v), 10), 'i')
+	case int8:
+		return append(strconv.AppendInt(buf, int64(v), 10), 'i')
+	case int16:
+		return append(strconv.AppendInt(buf, int64(v), 10), 'i')
+	case int32:
+		return append(strconv.AppendInt(buf, int64(v), 10), 'i')
+	case uint:
+		return append(strconv.AppendInt(buf, int64(v), 10), 'i')
+	case uint8:
+		return append(strconv.AppendInt(buf, int64(v), 10), 'i')
+	case uint16:
+		return append(strconv.AppendInt(buf, int64(v), 10), 'i')
+	case uint32:
+		return append(strconv.AppendInt(buf, int64(v), 10), 'i')
+	case uint64:
+		return append(strconv.AppendInt(buf, int64(v), 10), 'i')
+	case float64:
+		return strconv.AppendFloat(buf, v, 'f', -1, 64)
+	case float32:
+		return strconv.AppendFloat(buf, float64(v), 'f', -1, 32)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case string:
+		buf = append(buf, '"')
+		for i := 0; i < len(v); i++ {
+			if v[i] == '"' || v[i] == '\\' {
+				buf = append(buf, '\\')
+			}
+			buf = append(buf, v[i])
+		}
+		return append(buf, '"')
+	default:
+		// unknown types are written as strings
+		return appendFieldValue(buf, fmt.Sprint(v))
+	}
+}
+
+// Returns how many nanoseconds there are in a unit of the given precision
+func precisionUnit(precision string) int64 {
+	switch precision {
+	case "u":
+		return int64(time.Microsecond)
+	case "ms":
+		return int64(time.Millisecond)
+	case "s":
+		return int64(time.Second)
+	case "m":
+		return int64(time.Minute)
+	case "h":
+		return int64(time.Hour)
+	}
+	return 1
+}
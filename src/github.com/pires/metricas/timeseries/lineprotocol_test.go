@@ -0,0 +1,259 @@
+package timeseries
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	influxdb "github.com/influxdb/influxdb/client"
+	"github.com/influxdb/influxdb/models"
+)
+
+func TestLineProtocol(t *testing.T) {
+	at := time.Unix(1434055562, 5)
+	tests := []struct {
+		name  string
+		point Point
+		line  string
+	}{
+		{
+			name: "fields of every type",
+			point: Point{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "a", "region": "eu"},
+				Fields:      map[string]interface{}{"value": 0.64, "count": int64(3), "up": true, "state": "ok"},
+				Time:        at,
+			},
+			line: `cpu,host=a,region=eu count=3i,state="ok",up=true,value=0.64 1434055562000000005`,
+		},
+		{
+			name: "integers of every size",
+			point: Point{
+				Measurement: "ints",
+				Fields:      map[string]interface{}{"a": 1, "b": int8(-2), "c": uint16(3), "d": uint32(4), "e": float32(0.5), "f": uint64(math.MaxInt64)},
+				Time:        at,
+			},
+			line: `ints a=1i,b=-2i,c=3i,d=4i,e=0.5,f=9223372036854775807i 1434055562000000005`,
+		},
+		{
+			name: "measurement escapes",
+			point: Point{
+				Measurement: "http requests,total=all",
+				Fields:      map[string]interface{}{"value": int64(1)},
+				Time:        at,
+			},
+			line: `http\ requests\,total=all value=1i 1434055562000000005`,
+		},
+		{
+			name: "tag escapes",
+			point: Point{
+				Measurement: "http",
+				Tags:        map[string]string{"path name": "/api/v1,metrics", "a=b": "c=d"},
+				Fields:      map[string]interface{}{"value": int64(1)},
+				Time:        at,
+			},
+			line: `http,a\=b=c\=d,path\ name=/api/v1\,metrics value=1i 1434055562000000005`,
+		},
+		{
+			name: "field key escapes",
+			point: Point{
+				Measurement: "http",
+				Fields:      map[string]interface{}{"response time,ms": 12.5, "a=b": int64(1)},
+				Time:        at,
+			},
+			line: `http a\=b=1i,response\ time\,ms=12.5 1434055562000000005`,
+		},
+		{
+			name: "string field escapes",
+			point: Point{
+				Measurement: "log",
+				Fields:      map[string]interface{}{"message": `say "hi", C:\ = x`},
+				Time:        at,
+			},
+			line: `log message="say \"hi\", C:\\ = x" 1434055562000000005`,
+		},
+		{
+			name: "empty tag values left out",
+			point: Point{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "a", "region": ""},
+				Fields:      map[string]interface{}{"value": int64(1)},
+				Time:        at,
+			},
+			line: `cpu,host=a value=1i 1434055562000000005`,
+		},
+	}
+	for _, test := range tests {
+		lp := newLineProtocol("", 0)
+		if err := lp.append(&test.point); err != nil {
+			t.Errorf("%s: point skipped: %s", test.name, err)
+			continue
+		}
+		if got := lp.String(); got != test.line+"\n" {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.line+"\n")
+		}
+		parsed, err := models.ParsePoints(lp.buf)
+		if err != nil || len(parsed) != 1 {
+			t.Errorf("%s: InfluxDB fails parsing %q: %v", test.name, lp.String(), err)
+			continue
+		}
+		p := parsed[0]
+		if p.String() != test.line {
+			t.Errorf("%s: InfluxDB reads %q, want %q", test.name, p.String(), test.line)
+		}
+		if p.Name() != test.point.Measurement {
+			t.Errorf("%s: InfluxDB reads measurement %q, want %q", test.name, p.Name(), test.point.Measurement)
+		}
+		tags := make(map[string]string)
+		for k, v := range test.point.Tags {
+			if v != "" {
+				tags[k] = v
+			}
+		}
+		if !reflect.DeepEqual(map[string]string(p.Tags()), tags) {
+			t.Errorf("%s: InfluxDB reads tags %v, want %v", test.name, p.Tags(), tags)
+		}
+		for k, v := range test.point.Fields {
+			var want interface{}
+			switch v := v.(type) {
+			case int:
+				want = int64(v)
+			case int8:
+				want = int64(v)
+			case uint16:
+				want = int64(v)
+			case uint32:
+				want = int64(v)
+			case uint64:
+				want = int64(v)
+			case float32:
+				want = float64(v)
+			default:
+				want = v
+			}
+			if got := p.Fields()[k]; got != want {
+				t.Errorf("%s: InfluxDB reads field %s as %#v, want %#v", test.name, k, got, want)
+			}
+		}
+		if !p.Time().Equal(test.point.Time) {
+			t.Errorf("%s: InfluxDB reads time %s, want %s", test.name, p.Time(), test.point.Time)
+		}
+	}
+}
+
+func TestLineProtocolPrecision(t *testing.T) {
+	point := Point{
+		Measurement: "cpu",
+		Fields:      map[string]interface{}{"value": int64(1)},
+		Time:        time.Unix(1434055562, 123456789),
+	}
+	tests := []struct {
+		precision string
+		line      string
+	}{
+		{"", "cpu value=1i 1434055562123456789\n"},
+		{"u", "cpu value=1i 1434055562123456\n"},
+		{"ms", "cpu value=1i 1434055562123\n"},
+		{"s", "cpu value=1i 1434055562\n"},
+	}
+	for _, test := range tests {
+		lp := newLineProtocol(test.precision, 0)
+		lp.append(&point)
+		if got := lp.String(); got != test.line {
+			t.Errorf("precision %q: got %q, want %q", test.precision, got, test.line)
+		}
+	}
+}
+
+func TestLineProtocolSkipsPoints(t *testing.T) {
+	tests := []struct {
+		name  string
+		point Point
+		err   error
+	}{
+		{"without fields", Point{Measurement: "empty", Tags: map[string]string{"host": "a"}}, ErrNoFields},
+		{"NaN", Point{Measurement: "cpu", Fields: map[string]interface{}{"value": math.NaN()}}, ErrInvalidField},
+		{"infinity", Point{Measurement: "cpu", Fields: map[string]interface{}{"value": math.Inf(1)}}, ErrInvalidField},
+		{"negative infinity", Point{Measurement: "cpu", Fields: map[string]interface{}{"value": math.Inf(-1)}}, ErrInvalidField},
+		{"float32 infinity", Point{Measurement: "cpu", Fields: map[string]interface{}{"value": float32(math.Inf(1))}}, ErrInvalidField},
+		{"uint64 beyond int64", Point{Measurement: "cpu", Fields: map[string]interface{}{"count": uint64(math.MaxInt64) + 1}}, ErrInvalidField},
+		{"one invalid field", Point{Measurement: "cpu", Fields: map[string]interface{}{"count": int64(1), "value": math.NaN()}}, ErrInvalidField},
+	}
+	for _, test := range tests {
+		lp := newLineProtocol("", 0)
+		valid := Point{Measurement: "cpu", Fields: map[string]interface{}{"value": int64(1)}}
+		lp.append(&valid)
+		if err := lp.append(&test.point); err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+		lp.append(&valid)
+		if _, err := models.ParsePoints(lp.buf); err != nil {
+			t.Errorf("%s: InfluxDB fails parsing %q: %s", test.name, lp.String(), err)
+		}
+		if got, want := lp.String(), "cpu value=1i\ncpu value=1i\n"; got != want {
+			t.Errorf("%s: got %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+func benchmarkPoints(n int) []Point {
+	points := make([]Point, n)
+	now := time.Now()
+	for i := range points {
+		points[i] = Point{
+			Measurement: "http requests",
+			Tags: map[string]string{
+				"host":   fmt.Sprintf("server-%d", i%16),
+				"path":   "/api/v1,metrics",
+				"region": "eu-west",
+			},
+			Fields: map[string]interface{}{
+				"count":    int64(i),
+				"duration": int64(i * 1000),
+				"bytes":    int64(i * 512),
+			},
+			Time: now.Add(time.Duration(i) * time.Millisecond),
+		}
+	}
+	return points
+}
+
+// Serialization done by influxdb.Client.Write for a batch of points
+func BenchmarkBatchPoints(b *testing.B) {
+	points := make([]influxdb.Point, FLUSH_MAX_POINTS)
+	for i, point := range benchmarkPoints(FLUSH_MAX_POINTS) {
+		points[i] = influxdb.Point{
+			Measurement: point.Measurement,
+			Tags:        point.Tags,
+			Fields:      point.Fields,
+			Time:        point.Time,
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		for j := range points {
+			buf.WriteString(points[j].MarshalString())
+			buf.WriteByte('\n')
+		}
+		_ = buf.String()
+	}
+}
+
+func BenchmarkLineProtocol(b *testing.B) {
+	points := benchmarkPoints(FLUSH_MAX_POINTS)
+	lp := newLineProtocol("", 64*FLUSH_MAX_POINTS)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lp.reset()
+		for j := range points {
+			lp.append(&points[j])
+		}
+		_ = lp.String()
+	}
+}
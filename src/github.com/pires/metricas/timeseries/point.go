@@ -0,0 +1,52 @@
+package timeseries
+
+import (
+	"sort"
+	"time"
+)
+
+// A single sample of a measurement, independent of the backend storing it
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+	// where the point came from, e.g. the NATS subject it was received on,
+	// used for routing and never stored
+	Source string
+	// who sent the point, when known, e.g. the producer ID of a NATS metric or
+	// the user an HTTP request was authenticated as, never stored
+	Producer string
+	// position of the point among those of its producer, when known, 0
+	// otherwise, never stored
+	Sequence uint64
+	// when metricas received the point, never stored
+	Received time.Time
+	// retention policy the point is written to instead of the sink's, e.g.
+	// for late points, when set
+	RetentionPolicy string
+	// database the point is written to instead of the sink's, e.g. that of
+	// a tenant, when set
+	Database string
+}
+
+// Identifies the series the point belongs to, i.e. its measurement and tags
+// sorted by key, in the same format as the keys returned by InfluxDB's
+// SHOW SERIES, e.g. cpu,host=a,region=eu
+func (p *Point) Series() string {
+	keys := make([]string, 0, len(p.Tags))
+	for k, v := range p.Tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	buf := appendEscaped(make([]byte, 0, 64), p.Measurement, measurementEscapes)
+	for _, k := range keys {
+		buf = append(buf, ',')
+		buf = appendEscaped(buf, k, keyEscapes)
+		buf = append(buf, '=')
+		buf = appendEscaped(buf, p.Tags[k], keyEscapes)
+	}
+	return string(buf)
+}
@@ -0,0 +1,313 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix of the continuous queries metricas manages, dropped once their
+	// downsampling tier is removed from the configuration
+	CONTINUOUS_QUERY_PREFIX = "metricas_"
+	DOWNSAMPLING_FUNCTION   = "mean"
+)
+
+type ProvisionConfiguration struct {
+	// retention policies to create when missing and alter when they differ
+	RetentionPolicies []*RetentionPolicyConfiguration
+	// tiers of rolled up data, each maintained by a continuous query
+	Downsampling []*DownsamplingConfiguration
+	// logs the statements that would be executed instead of executing them
+	DryRun bool
+}
+
+type RetentionPolicyConfiguration struct {
+	Name string
+	// how long data is kept, forever when zero, at least an hour otherwise
+	Duration time.Duration
+	// copies of the data in a cluster, defaults to 1
+	Replication int
+	// whether queries not naming a retention policy read from this one
+	Default bool
+}
+
+// Rolls up every measurement of a retention policy into another one, e.g. the
+// mean of every field per minute, kept for a year
+type DownsamplingConfiguration struct {
+	// time rolled up points are apart
+	Interval time.Duration
+	// retention policy rolled up points are written to, one per tier
+	RetentionPolicy string
+	// retention policy rolled up points are read from, defaults to the one
+	// the sink writes to
+	Source string
+	// aggregate function, defaults to DOWNSAMPLING_FUNCTION
+	Function string
+}
+
+// Checks retention policies and downsampling tiers, filling in defaults
+func (config *ProvisionConfiguration) validate(defaultRp string) error {
+	names := make(map[string]bool, len(config.RetentionPolicies))
+	defaults := 0
+	for _, rp := range config.RetentionPolicies {
+		if rp.Name == "" {
+			return errors.New("retention policies must be named")
+		}
+		if names[rp.Name] {
+			return fmt.Errorf("retention policy %s defined twice", rp.Name)
+		}
+		names[rp.Name] = true
+		if rp.Duration != 0 && rp.Duration < time.Hour {
+			return fmt.Errorf("retention policy %s: duration %s is shorter than an hour", rp.Name, rp.Duration)
+		}
+		if rp.Replication <= 0 {
+			rp.Replication = 1
+		}
+		if rp.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return errors.New("only one retention policy may be the default")
+	}
+
+	tiers := make(map[string]bool, len(config.Downsampling))
+	for _, tier := range config.Downsampling {
+		if tier.RetentionPolicy == "" {
+			return errors.New("downsampling tiers need a retention policy")
+		}
+		if tiers[tier.RetentionPolicy] {
+			return fmt.Errorf("downsampling tiers must write to different retention policies, %s is used twice", tier.RetentionPolicy)
+		}
+		tiers[tier.RetentionPolicy] = true
+		if tier.Interval < time.Second || tier.Interval%time.Second != 0 {
+			return fmt.Errorf("downsampling tier %s: interval %s is not a whole number of seconds", tier.RetentionPolicy, tier.Interval)
+		}
+		if tier.Source == "" {
+			tier.Source = defaultRp
+		}
+		if tier.Source == tier.RetentionPolicy {
+			return fmt.Errorf("downsampling tier %s reads from the retention policy it writes to", tier.RetentionPolicy)
+		}
+		switch tier.Function {
+		case "":
+			tier.Function = DOWNSAMPLING_FUNCTION
+		case "mean", "median", "sum", "count", "min", "max", "first", "last", "spread", "stddev":
+		default:
+			return fmt.Errorf("downsampling tier %s: invalid function %q, must be one of mean, median, sum, count, min, max, first, last, spread or stddev", tier.RetentionPolicy, tier.Function)
+		}
+	}
+	return nil
+}
+
+// Name of the continuous query maintaining the tier
+func (tier *DownsamplingConfiguration) name() string {
+	return CONTINUOUS_QUERY_PREFIX + tier.RetentionPolicy
+}
+
+// Statement creating the continuous query maintaining the tier
+func (tier *DownsamplingConfiguration) statement(db string) string {
+	return fmt.Sprintf("CREATE CONTINUOUS QUERY %s ON %s BEGIN SELECT %s(*) INTO %s.%s.:MEASUREMENT FROM %s.%s./.*/ GROUP BY time(%s), * END",
+		quoteIdent(tier.name()), quoteIdent(db), tier.Function,
+		quoteIdent(db), quoteIdent(tier.RetentionPolicy), quoteIdent(db), quoteIdent(tier.Source),
+		formatDuration(tier.Interval))
+}
+
+// Creates the database, its retention policies and the continuous queries of
+// its downsampling tiers when missing, and replaces those that differ from
+// their configuration, e.g. after changing it
+func provision(client *influxClient, db string, config *ProvisionConfiguration) error {
+	p := &provisioner{client: client, db: db, dryRun: config.DryRun}
+	exists, err := p.databaseExists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := p.exec("CREATE DATABASE " + quoteIdent(db)); err != nil {
+			return fmt.Errorf("failed creating database %s: %s", db, err)
+		}
+	}
+	if err := p.retentionPolicies(config.RetentionPolicies, exists); err != nil {
+		return err
+	}
+	return p.continuousQueries(config.Downsampling, exists)
+}
+
+type provisioner struct {
+	client *influxClient
+	db     string
+	dryRun bool
+}
+
+func (p *provisioner) databaseExists() (bool, error) {
+	rows, err := p.client.Rows("SHOW DATABASES", "")
+	if err != nil {
+		return false, err
+	}
+	for _, row := range rows {
+		if row["name"] == p.db {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Creates the retention policies that are missing and alters those that
+// differ. Those of a database that does not exist yet are all missing.
+func (p *provisioner) retentionPolicies(rps []*RetentionPolicyConfiguration, exists bool) error {
+	current := make(map[string]*RetentionPolicyConfiguration)
+	if exists {
+		rows, err := p.client.Rows("SHOW RETENTION POLICIES ON "+quoteIdent(p.db), p.db)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			rp, err := parseRetentionPolicy(row)
+			if err != nil {
+				return fmt.Errorf("unexpected retention policy of database %s: %s", p.db, err)
+			}
+			current[rp.Name] = rp
+		}
+	}
+	for _, rp := range rps {
+		statement := "CREATE"
+		if cur, ok := current[rp.Name]; ok {
+			// a policy stops being the default only when another one becomes it
+			if cur.Duration == rp.Duration && cur.Replication == rp.Replication && (cur.Default || !rp.Default) {
+				continue
+			}
+			statement = "ALTER"
+			log.Printf("Retention policy %s of database %s is %s instead of %s.", rp.Name, p.db, cur, rp)
+		}
+		q := fmt.Sprintf("%s RETENTION POLICY %s ON %s DURATION %s REPLICATION %d", statement, quoteIdent(rp.Name), quoteIdent(p.db), formatDuration(rp.Duration), rp.Replication)
+		if rp.Default {
+			q += " DEFAULT"
+		}
+		if err := p.exec(q); err != nil {
+			return fmt.Errorf("failed provisioning retention policy %s of database %s: %s", rp.Name, p.db, err)
+		}
+	}
+	return nil
+}
+
+// Creates the continuous queries of downsampling tiers, replacing those that
+// differ, since they cannot be altered, and drops those of removed tiers
+func (p *provisioner) continuousQueries(tiers []*DownsamplingConfiguration, exists bool) error {
+	current := make(map[string]string)
+	if exists {
+		rows, err := p.client.Rows("SHOW CONTINUOUS QUERIES", "")
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			name, _ := row["name"].(string)
+			query, _ := row["query"].(string)
+			if row[SERIES_COLUMN] == p.db && strings.HasPrefix(name, CONTINUOUS_QUERY_PREFIX) {
+				current[name] = query
+			}
+		}
+	}
+	for _, tier := range tiers {
+		name, statement := tier.name(), tier.statement(p.db)
+		if query, ok := current[name]; ok {
+			delete(current, name)
+			if sameStatement(query, statement) {
+				continue
+			}
+			log.Printf("Continuous query %s of database %s differs from its downsampling tier: %s", name, p.db, query)
+			if err := p.dropContinuousQuery(name); err != nil {
+				return err
+			}
+		}
+		if err := p.exec(statement); err != nil {
+			return fmt.Errorf("failed creating continuous query %s of database %s: %s", name, p.db, err)
+		}
+	}
+	for name := range current {
+		if err := p.dropContinuousQuery(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *provisioner) dropContinuousQuery(name string) error {
+	if err := p.exec(fmt.Sprintf("DROP CONTINUOUS QUERY %s ON %s", quoteIdent(name), quoteIdent(p.db))); err != nil {
+		return fmt.Errorf("failed dropping continuous query %s of database %s: %s", name, p.db, err)
+	}
+	return nil
+}
+
+// Executes a statement, or only logs it on dry runs
+func (p *provisioner) exec(statement string) error {
+	if p.dryRun {
+		log.Printf("Would execute on InfluxDB %s: %s", p.client.url.Host, statement)
+		return nil
+	}
+	if _, err := p.client.Query(statement, p.db); err != nil {
+		return err
+	}
+	log.Printf("Executed on InfluxDB %s: %s", p.client.url.Host, statement)
+	return nil
+}
+
+// InfluxDB returns continuous queries as it formats them, quoting identifiers
+// only when needed
+func sameStatement(a, b string) bool {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Join(strings.Fields(strings.Replace(s, `"`, "", -1)), " "))
+	}
+	return normalize(a) == normalize(b)
+}
+
+// Reads a row of SHOW RETENTION POLICIES
+func parseRetentionPolicy(row map[string]interface{}) (*RetentionPolicyConfiguration, error) {
+	name, _ := row["name"].(string)
+	duration, _ := row["duration"].(string)
+	replication, _ := row["replicaN"].(json.Number)
+	isDefault, _ := row["default"].(bool)
+	rp := &RetentionPolicyConfiguration{Name: name, Default: isDefault}
+	var err error
+	if rp.Duration, err = time.ParseDuration(duration); err != nil {
+		return nil, err
+	}
+	n, err := replication.Int64()
+	if err != nil {
+		return nil, err
+	}
+	rp.Replication = int(n)
+	return rp, nil
+}
+
+func (rp *RetentionPolicyConfiguration) String() string {
+	s := fmt.Sprintf("duration %s, replication %d", formatDuration(rp.Duration), rp.Replication)
+	if rp.Default {
+		s += ", default"
+	}
+	return s
+}
+
+// Formats a duration as an InfluxQL literal, INF meaning forever
+func formatDuration(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "INF"
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
+
+// Parses a retention policy duration, INF meaning forever
+func ParseRetentionDuration(s string) (time.Duration, error) {
+	if strings.EqualFold(s, "INF") {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,219 @@
+package timeseries
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake InfluxDB answering SHOW statements from its state, and recording the
+// others
+type provisionedInfluxDB struct {
+	mu        sync.Mutex
+	databases []string
+	rps       [][]interface{} // name, duration, replicaN, default
+	cqs       [][]interface{} // name, query
+	executed  []string
+}
+
+func (db *provisionedInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	q := r.URL.Query().Get("q")
+	series := map[string]interface{}{}
+	switch {
+	case q == "SHOW DATABASES":
+		var values [][]interface{}
+		for _, name := range db.databases {
+			values = append(values, []interface{}{name})
+		}
+		series = map[string]interface{}{"name": "databases", "columns": []string{"name"}, "values": values}
+	case strings.HasPrefix(q, "SHOW RETENTION POLICIES"):
+		series = map[string]interface{}{"columns": []string{"name", "duration", "replicaN", "default"}, "values": db.rps}
+	case q == "SHOW CONTINUOUS QUERIES":
+		series = map[string]interface{}{"name": "metrics", "columns": []string{"name", "query"}, "values": db.cqs}
+	default:
+		db.executed = append(db.executed, q)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": []interface{}{map[string]interface{}{"series": []interface{}{series}}},
+	})
+}
+
+func TestProvisionRetentionPolicies(t *testing.T) {
+	rps := []*RetentionPolicyConfiguration{
+		{Name: "week", Duration: 168 * time.Hour, Replication: 1, Default: true},
+		{Name: "forever", Replication: 2},
+	}
+	tests := []struct {
+		name      string
+		databases []string
+		rps       [][]interface{}
+		executed  []string
+	}{
+		{
+			name: "missing database",
+			executed: []string{
+				`CREATE DATABASE "metrics"`,
+				`CREATE RETENTION POLICY "week" ON "metrics" DURATION 168h REPLICATION 1 DEFAULT`,
+				`CREATE RETENTION POLICY "forever" ON "metrics" DURATION INF REPLICATION 2`,
+			},
+		},
+		{
+			name:      "missing retention policies",
+			databases: []string{"_internal", "metrics"},
+			rps:       [][]interface{}{{"default", "0", 1, true}},
+			executed: []string{
+				`CREATE RETENTION POLICY "week" ON "metrics" DURATION 168h REPLICATION 1 DEFAULT`,
+				`CREATE RETENTION POLICY "forever" ON "metrics" DURATION INF REPLICATION 2`,
+			},
+		},
+		{
+			name:      "retention policies as configured",
+			databases: []string{"metrics"},
+			rps:       [][]interface{}{{"week", "168h0m0s", 1, true}, {"forever", "0", 2, false}},
+		},
+		{
+			name:      "retention policies differing",
+			databases: []string{"metrics"},
+			rps:       [][]interface{}{{"week", "24h0m0s", 1, false}, {"forever", "0", 1, false}},
+			executed: []string{
+				`ALTER RETENTION POLICY "week" ON "metrics" DURATION 168h REPLICATION 1 DEFAULT`,
+				`ALTER RETENTION POLICY "forever" ON "metrics" DURATION INF REPLICATION 2`,
+			},
+		},
+		{
+			name:      "default retention policy not configured as the default",
+			databases: []string{"metrics"},
+			rps:       [][]interface{}{{"week", "168h0m0s", 1, true}, {"forever", "0", 2, true}},
+		},
+	}
+	for _, test := range tests {
+		db := &provisionedInfluxDB{databases: test.databases, rps: test.rps}
+		server := httptest.NewServer(db)
+		client, err := newInfluxClient(&InfluxDBConfiguration{AddrInfluxDb: strings.TrimPrefix(server.URL, "http://")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := provision(client, "metrics", &ProvisionConfiguration{RetentionPolicies: rps}); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(db.executed, test.executed) {
+			t.Errorf("%s: executed %q, want %q", test.name, db.executed, test.executed)
+		}
+		server.Close()
+	}
+}
+
+func TestProvisionContinuousQueries(t *testing.T) {
+	tiers := []*DownsamplingConfiguration{
+		{Interval: time.Hour, RetentionPolicy: "year", Source: "week", Function: "mean"},
+	}
+	create := `CREATE CONTINUOUS QUERY "metricas_year" ON "metrics" BEGIN SELECT mean(*) INTO "metrics"."year".:MEASUREMENT FROM "metrics"."week"./.*/ GROUP BY time(1h), * END`
+	tests := []struct {
+		name      string
+		databases []string
+		cqs       [][]interface{}
+		executed  []string
+	}{
+		{
+			name:     "missing database",
+			executed: []string{`CREATE DATABASE "metrics"`, create},
+		},
+		{
+			name:      "missing continuous query",
+			databases: []string{"metrics"},
+			executed:  []string{create},
+		},
+		{
+			name:      "continuous query as configured, formatted by InfluxDB",
+			databases: []string{"metrics"},
+			cqs: [][]interface{}{
+				{"metricas_year", `CREATE CONTINUOUS QUERY metricas_year ON metrics BEGIN SELECT mean(*) INTO metrics.year.:MEASUREMENT FROM metrics.week./.*/ GROUP BY time(1h), * END`},
+			},
+		},
+		{
+			name:      "continuous query differing",
+			databases: []string{"metrics"},
+			cqs: [][]interface{}{
+				{"metricas_year", `CREATE CONTINUOUS QUERY metricas_year ON metrics BEGIN SELECT mean(*) INTO metrics.year.:MEASUREMENT FROM metrics.week./.*/ GROUP BY time(5m), * END`},
+			},
+			executed: []string{`DROP CONTINUOUS QUERY "metricas_year" ON "metrics"`, create},
+		},
+		{
+			name:      "continuous query of a removed tier",
+			databases: []string{"metrics"},
+			cqs: [][]interface{}{
+				{"metricas_month", `CREATE CONTINUOUS QUERY metricas_month ON metrics BEGIN SELECT mean(*) INTO metrics.month.:MEASUREMENT FROM metrics.week./.*/ GROUP BY time(1m), * END`},
+				{"custom", `CREATE CONTINUOUS QUERY custom ON metrics BEGIN SELECT max(*) INTO metrics.week.peaks FROM metrics.week.cpu GROUP BY time(1m), * END`},
+			},
+			executed: []string{create, `DROP CONTINUOUS QUERY "metricas_month" ON "metrics"`},
+		},
+	}
+	for _, test := range tests {
+		db := &provisionedInfluxDB{databases: test.databases, cqs: test.cqs}
+		server := httptest.NewServer(db)
+		host := strings.TrimPrefix(server.URL, "http://")
+		client, err := newInfluxClient(&InfluxDBConfiguration{AddrInfluxDb: host})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// dry runs log the statements instead of executing them
+		var logged bytes.Buffer
+		log.SetFlags(0)
+		log.SetOutput(&logged)
+		err = provision(client, "metrics", &ProvisionConfiguration{Downsampling: tiers, DryRun: true})
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		if err != nil {
+			t.Errorf("%s: dry run: %s", test.name, err)
+		}
+		if len(db.executed) > 0 {
+			t.Errorf("%s: dry run executed %q", test.name, db.executed)
+		}
+		var wouldExecute []string
+		for _, line := range strings.Split(logged.String(), "\n") {
+			if strings.HasPrefix(line, "Would execute on InfluxDB "+host+": ") {
+				wouldExecute = append(wouldExecute, strings.TrimPrefix(line, "Would execute on InfluxDB "+host+": "))
+			}
+		}
+		if !reflect.DeepEqual(wouldExecute, test.executed) {
+			t.Errorf("%s: dry run logged %q, want %q", test.name, wouldExecute, test.executed)
+		}
+
+		if err := provision(client, "metrics", &ProvisionConfiguration{Downsampling: tiers}); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !reflect.DeepEqual(db.executed, test.executed) {
+			t.Errorf("%s: executed %q, want %q", test.name, db.executed, test.executed)
+		}
+		server.Close()
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d time.Duration
+		s string
+	}{
+		{0, "INF"},
+		{time.Hour, "1h"},
+		{8760 * time.Hour, "8760h"},
+		{90 * time.Minute, "90m"},
+		{90 * time.Second, "90s"},
+	}
+	for _, test := range tests {
+		if s := formatDuration(test.d); s != test.s {
+			t.Errorf("%s: got %s, want %s", test.d, s, test.s)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package timeseries
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats"
+)
+
+// Where points InfluxDB rejects, or would reject, are set aside, to be fixed
+// and replayed. They are written in line protocol, preceded by a comment with
+// the reason, which InfluxDB ignores.
+type QuarantineConfiguration struct {
+	// file quarantined points are appended to
+	Path string
+	// NATS subject quarantined points are published to, one message per
+	// batch, through Servers, as host:port or nats:// URLs, authenticating
+	// as User or with Token unless the URLs have credentials
+	Subject  string
+	Servers  []string
+	User     string
+	Password string
+	Token    string
+	// connects to NATS over TLS, verifying the server certificate against
+	// CACert or the system CAs unless InsecureSkipVerify, presenting the
+	// client certificate of Cert and Key if any, all PEM files
+	Secure             bool
+	CACert             string
+	Cert               string
+	Key                string
+	InsecureSkipVerify bool
+}
+
+type quarantine struct {
+	file      *os.File
+	nc        *nats.Conn
+	subject   string
+	lineProto *lineProtocol
+}
+
+func (config *QuarantineConfiguration) validate() error {
+	if config.Path == "" && config.Subject == "" {
+		return errors.New("missing quarantine path or subject")
+	}
+	if config.Subject != "" {
+		if len(config.Servers) == 0 {
+			return errors.New("quarantine subject requires NATS servers")
+		}
+		if _, err := config.serverURLs(); err != nil {
+			return err
+		}
+		if _, err := config.tlsConfig(); err != nil {
+			return fmt.Errorf("quarantine NATS TLS: %s", err)
+		}
+	}
+	return nil
+}
+
+// Returns the TLS configuration of secure NATS connections, nil otherwise
+func (config *QuarantineConfiguration) tlsConfig() (*tls.Config, error) {
+	if !config.Secure {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CACert != "" {
+		pem, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CACert)
+		}
+	}
+	if config.Cert != "" || config.Key != "" {
+		cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Returns the URLs of the NATS servers, with credentials
+func (config *QuarantineConfiguration) serverURLs() ([]string, error) {
+	urls := make([]string, len(config.Servers))
+	for i, server := range config.Servers {
+		if !strings.Contains(server, "://") {
+			server = "nats://" + server
+		}
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid quarantine NATS server %q", config.Servers[i])
+		}
+		if u.User == nil && config.User != "" {
+			u.User = url.UserPassword(config.User, config.Password)
+		}
+		urls[i] = u.String()
+	}
+	return urls, nil
+}
+
+func newQuarantine(config *QuarantineConfiguration, precision string) (*quarantine, error) {
+	q := &quarantine{
+		subject:   config.Subject,
+		lineProto: newLineProtocol(precision, 256),
+	}
+	if config.Path != "" {
+		f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		q.file = f
+	}
+	if config.Subject != "" {
+		urls, err := config.serverURLs()
+		if err != nil {
+			q.close()
+			return nil, err
+		}
+		opts := nats.DefaultOptions
+		opts.Servers = urls
+		opts.Token = config.Token
+		opts.Secure = config.Secure
+		opts.TLSConfig, _ = config.tlsConfig() // validated already
+		opts.MaxReconnect = -1
+		if q.nc, err = opts.Connect(); err != nil {
+			q.close()
+			return nil, fmt.Errorf("connecting to NATS for quarantine: %s", err)
+		}
+	}
+	return q, nil
+}
+
+// Sets points aside, along with the reason they were rejected
+func (q *quarantine) write(points []Point, reason error) error {
+	q.lineProto.reset()
+	for _, line := range strings.Split(reason.Error(), "\n") {
+		q.lineProto.buf = append(q.lineProto.buf, "# "...)
+		q.lineProto.buf = append(q.lineProto.buf, line...)
+		q.lineProto.buf = append(q.lineProto.buf, '\n')
+	}
+	for i := range points {
+		q.lineProto.append(&points[i])
+	}
+	// written at once, so that batches do not interleave in the file
+	if q.file != nil {
+		if _, err := q.file.Write(q.lineProto.buf); err != nil {
+			return err
+		}
+	}
+	if q.nc != nil {
+		return q.nc.Publish(q.subject, q.lineProto.buf)
+	}
+	return nil
+}
+
+func (q *quarantine) close() error {
+	var err error
+	if q.nc != nil {
+		err = q.nc.Flush()
+		q.nc.Close()
+	}
+	if q.file != nil {
+		if cerr := q.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package timeseries
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Errors of InfluxDB naming the points it rejected, e.g.
+//
+//	unable to parse 'cpu value=': missing field value
+//	field type conflict: input field "value" on measurement "cpu" is type float, already exists as type integer
+//
+// InfluxDB 1.0 and later prefix them with "partial write: " when they wrote
+// the other points of the batch.
+var fieldTypeConflict = regexp.MustCompile(`input field "([^"]*)" on measurement "([^"]*)" is type (\w+), already exists as type (\w+)`)
+
+const partialWrite = "partial write"
+
+// Returns the points of a batch written to db named by the error InfluxDB
+// rejected it with, the others, and whether InfluxDB wrote them anyway
+func (ts *influxDbSink) rejectedPoints(points []Point, db string, err error) (rejected, kept []Point, partial bool) {
+	message := err.Error()
+	partial = strings.HasPrefix(message, partialWrite)
+
+	conflicts := make(map[string]map[string]string) // field types rejected, by measurement and field
+	for _, m := range fieldTypeConflict.FindAllStringSubmatch(message, -1) {
+		field, measurement, typ, existing := m[1], m[2], influxFieldType(m[3]), influxFieldType(m[4])
+		if conflicts[measurement] == nil {
+			conflicts[measurement] = make(map[string]string)
+		}
+		conflicts[measurement][field] = typ
+		if ft, ok := ts.fieldTypes[db]; ok {
+			ft.learn(measurement, field, existing)
+		}
+	}
+	parseErrors := strings.Contains(message, "unable to parse '")
+
+	lineProto := newLineProtocol(ts.config.Precision, 256)
+	for _, point := range points {
+		if hasFieldTypes(point, conflicts) {
+			rejected = append(rejected, point)
+			continue
+		}
+		if parseErrors {
+			lineProto.reset()
+			lineProto.append(&point)
+			line := strings.TrimSuffix(lineProto.String(), "\n")
+			if strings.Contains(message, "unable to parse '"+line+"'") {
+				rejected = append(rejected, point)
+				continue
+			}
+		}
+		kept = append(kept, point)
+	}
+	return rejected, kept, partial
+}
+
+// Whether a point has any of the given field types
+func hasFieldTypes(point Point, types map[string]map[string]string) bool {
+	for field, typ := range types[point.Measurement] {
+		if v, ok := point.Fields[field]; ok && fieldType(v) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the field type of the name InfluxDB gives it, older versions naming
+// them after Go types
+func influxFieldType(name string) string {
+	switch name {
+	case "float64":
+		return FIELD_TYPE_FLOAT
+	case "int64":
+		return FIELD_TYPE_INTEGER
+	case "bool":
+		return FIELD_TYPE_BOOLEAN
+	}
+	return name
+}
@@ -0,0 +1,263 @@
+package timeseries
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdb/influxdb/models"
+	"github.com/pires/metricas/instrument"
+)
+
+func TestRejectedPoints(t *testing.T) {
+	at := time.Unix(1434055562, 5)
+	points := []Point{
+		{Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"value": 0.5}, Time: at},
+		{Measurement: "cpu", Tags: map[string]string{"host": "b"}, Fields: map[string]interface{}{"value": int64(1)}, Time: at},
+		{Measurement: "mem", Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"value": 0.5}, Time: at},
+		{Measurement: "disk", Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"free": int64(3), "used": "x"}, Time: at},
+	}
+	tests := []struct {
+		name     string
+		message  string
+		rejected []int // indexes into points
+		partial  bool
+		learnt   map[string]map[string]string
+	}{
+		{
+			name:     "field type conflict",
+			message:  `field type conflict: input field "value" on measurement "cpu" is type float, already exists as type integer`,
+			rejected: []int{0},
+			learnt:   map[string]map[string]string{"cpu": {"value": FIELD_TYPE_INTEGER}},
+		},
+		{
+			name:     "partial write of a field type conflict",
+			message:  `partial write: field type conflict: input field "value" on measurement "cpu" is type float, already exists as type integer dropped=1`,
+			rejected: []int{0},
+			partial:  true,
+			learnt:   map[string]map[string]string{"cpu": {"value": FIELD_TYPE_INTEGER}},
+		},
+		{
+			name:     "field type conflict named after Go types",
+			message:  `field type conflict: input field "value" on measurement "cpu" is type int64, already exists as type float64`,
+			rejected: []int{1},
+			learnt:   map[string]map[string]string{"cpu": {"value": FIELD_TYPE_FLOAT}},
+		},
+		{
+			name: "field type conflicts on several measurements",
+			message: `partial write: field type conflict: input field "value" on measurement "cpu" is type float, already exists as type integer dropped=1` +
+				"\n" + `field type conflict: input field "used" on measurement "disk" is type string, already exists as type float dropped=1`,
+			rejected: []int{0, 3},
+			partial:  true,
+			learnt:   map[string]map[string]string{"cpu": {"value": FIELD_TYPE_INTEGER}, "disk": {"used": FIELD_TYPE_FLOAT}},
+		},
+		{
+			name:     "field type conflict on another measurement",
+			message:  `field type conflict: input field "value" on measurement "load" is type float, already exists as type integer`,
+			learnt:   map[string]map[string]string{"load": {"value": FIELD_TYPE_INTEGER}},
+			rejected: nil,
+		},
+		{
+			name:     "parse error",
+			message:  `unable to parse 'mem,host=a value=0.5 1434055562000000005': invalid field format`,
+			rejected: []int{2},
+		},
+		{
+			name: "partial write of parse errors",
+			message: `partial write: unable to parse 'cpu,host=b value=1i 1434055562000000005': bad timestamp` +
+				"\n" + `unable to parse 'disk,host=a free=3i,used="x" 1434055562000000005': invalid field format`,
+			rejected: []int{1, 3},
+			partial:  true,
+		},
+		{
+			name:     "parse error of a line not written",
+			message:  `unable to parse 'mem,host=b value=0.5 1434055562000000005': invalid field format`,
+			rejected: nil,
+		},
+		{
+			name:     "points not named",
+			message:  `partial write: points beyond retention policy dropped=2`,
+			rejected: nil,
+			partial:  true,
+		},
+		{
+			name:     "request too large",
+			message:  `request entity too large`,
+			rejected: nil,
+		},
+	}
+	for _, test := range tests {
+		ts := &influxDbSink{
+			config:     &InfluxDBConfiguration{},
+			fieldTypes: map[string]*fieldTypes{"metrics": newFieldTypes(FIELD_CONFLICTS_QUARANTINE)},
+		}
+		rejected, kept, partial := ts.rejectedPoints(points, "metrics", errors.New(test.message))
+		var want, wantKept []Point
+		for i, point := range points {
+			if containsIndex(test.rejected, i) {
+				want = append(want, point)
+			} else {
+				wantKept = append(wantKept, point)
+			}
+		}
+		if !reflect.DeepEqual(rejected, want) {
+			t.Errorf("%s: rejected %v, want %v", test.name, rejected, want)
+		}
+		if !reflect.DeepEqual(kept, wantKept) {
+			t.Errorf("%s: kept %v, want %v", test.name, kept, wantKept)
+		}
+		if partial != test.partial {
+			t.Errorf("%s: partial %t, want %t", test.name, partial, test.partial)
+		}
+		learnt := ts.fieldTypes["metrics"].types
+		if test.learnt == nil {
+			test.learnt = map[string]map[string]string{}
+		}
+		if !reflect.DeepEqual(learnt, test.learnt) {
+			t.Errorf("%s: learnt field types %v, want %v", test.name, learnt, test.learnt)
+		}
+	}
+}
+
+func containsIndex(indexes []int, i int) bool {
+	for _, j := range indexes {
+		if i == j {
+			return true
+		}
+	}
+	return false
+}
+
+// Fake InfluxDB rejecting, without naming them, the batches holding any of
+// the points whose id field is rejected
+type rejectingInfluxDB struct {
+	mu       sync.Mutex
+	rejected map[int64]bool
+	written  []int64
+}
+
+func (db *rejectingInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	points, err := models.ParsePoints(body)
+	if err != nil {
+		http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, p := range points {
+		if db.rejected[p.Fields()["id"].(int64)] {
+			http.Error(w, `{"error":"batch rejected"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, p := range points {
+		db.written = append(db.written, p.Fields()["id"].(int64))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestWriteBatchBisection(t *testing.T) {
+	tests := []struct {
+		name     string
+		points   int
+		rejected []int64
+	}{
+		{"none", 8, nil},
+		{"first", 8, []int64{0}},
+		{"last", 8, []int64{7}},
+		{"several", 13, []int64{2, 3, 9}},
+		{"all", 5, []int64{0, 1, 2, 3, 4}},
+		{"single", 1, []int64{0}},
+	}
+	for _, test := range tests {
+		db := &rejectingInfluxDB{rejected: make(map[int64]bool)}
+		for _, id := range test.rejected {
+			db.rejected[id] = true
+		}
+		server := httptest.NewServer(db)
+		f, err := ioutil.TempFile("", "quarantine")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := &InfluxDBConfiguration{AddrInfluxDb: strings.TrimPrefix(server.URL, "http://"), DbName: "metrics"}
+		if err := config.validate(); err != nil {
+			t.Fatal(err)
+		}
+		client, err := newInfluxClient(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := &influxDbSink{
+			config:     config,
+			db:         client,
+			quarantine: &quarantine{file: f, lineProto: newLineProtocol("", 256)},
+			lineProto:  newLineProtocol("", 0),
+			stop:       make(chan struct{}),
+		}
+		ts.instrument(instrument.NewRegistry())
+
+		points := make([]Point, test.points)
+		for i := range points {
+			points[i] = Point{Measurement: "cpu", Fields: map[string]interface{}{"id": int64(i)}}
+		}
+		held, err := ts.writeBatch(points, destination{db: "metrics", rp: config.RetentionPolicy})
+		if len(held) != 0 || err != nil {
+			t.Errorf("%s: %d points held, error %v", test.name, len(held), err)
+		}
+
+		var want []int64
+		for i := range points {
+			if !db.rejected[int64(i)] {
+				want = append(want, int64(i))
+			}
+		}
+		sort.Sort(ids(db.written))
+		if !reflect.DeepEqual(db.written, want) {
+			t.Errorf("%s: points %v written, want %v", test.name, db.written, want)
+		}
+		if quarantined := quarantinedIDs(t, f.Name()); !reflect.DeepEqual(quarantined, test.rejected) {
+			t.Errorf("%s: points %v quarantined, want %v", test.name, quarantined, test.rejected)
+		}
+		if written, quarantined := ts.written.Value(), ts.quarantined.Value(); written != uint64(len(want)) || quarantined != uint64(len(test.rejected)) {
+			t.Errorf("%s: counted %d points written and %d quarantined, want %d and %d", test.name, written, quarantined, len(want), len(test.rejected))
+		}
+
+		server.Close()
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// Returns the id field of the points quarantined to a file, sorted
+func quarantinedIDs(t *testing.T, path string) []int64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := models.ParsePoints(data)
+	if err != nil {
+		t.Fatalf("InfluxDB fails parsing the quarantine %q: %s", data, err)
+	}
+	var quarantined []int64
+	for _, p := range points {
+		quarantined = append(quarantined, p.Fields()["id"].(int64))
+	}
+	sort.Sort(ids(quarantined))
+	return quarantined
+}
+
+type ids []int64
+
+func (s ids) Len() int           { return len(s) }
+func (s ids) Less(i, j int) bool { return s[i] < s[j] }
+func (s ids) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
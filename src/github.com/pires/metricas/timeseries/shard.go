@@ -0,0 +1,181 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	SINK_SHARD = "shard"
+)
+
+type ShardConfiguration struct {
+	// shards series are distributed across, identified on the hash ring by
+	// name, so names must not change once data has been written
+	Sinks []*SinkConfiguration
+	// virtual nodes per shard, defaults to HASH_RING_VIRTUAL_NODES
+	VirtualNodes int
+	// shards every series is written to, defaults to 1
+	ReplicationFactor int
+}
+
+func init() {
+	RegisterSink(SINK_SHARD, func(config *SinkConfiguration) (Sink, error) {
+		if config.Shard == nil {
+			return nil, errors.New("missing shard sink configuration")
+		}
+		return NewShardSink(config.Shard)
+	})
+}
+
+// Distributes series across several backends using consistent hashing, so that
+// all points of a series end up in the same backends
+type shardSink struct {
+	ring     *HashRing
+	shards   []Sink
+	names    []string
+	replicas int
+	failed   []uint64 // by shard, updated atomically
+}
+
+func NewShardSink(config *ShardConfiguration) (Sink, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	ss := &shardSink{
+		replicas: config.ReplicationFactor,
+		failed:   make([]uint64, len(config.Sinks)),
+	}
+	for _, shardConfig := range config.Sinks {
+		sink, err := NewSink(shardConfig)
+		if err != nil {
+			ss.Close()
+			return nil, fmt.Errorf("shard %s: %s", shardConfig.Name, err)
+		}
+		ss.shards = append(ss.shards, sink)
+		ss.names = append(ss.names, shardConfig.Name)
+	}
+	ss.ring = NewHashRing(ss.names, config.VirtualNodes)
+
+	return ss, nil
+}
+
+func (config *ShardConfiguration) validate() error {
+	if len(config.Sinks) == 0 {
+		return errors.New("shard sink needs at least one shard")
+	}
+	if config.ReplicationFactor <= 0 {
+		config.ReplicationFactor = 1
+	}
+	if config.ReplicationFactor > len(config.Sinks) {
+		return fmt.Errorf("replication factor %d exceeds the %d shards", config.ReplicationFactor, len(config.Sinks))
+	}
+	names := make(map[string]bool, len(config.Sinks))
+	for _, shardConfig := range config.Sinks {
+		if shardConfig.Name == "" {
+			return errors.New("shards must be named")
+		}
+		if names[shardConfig.Name] {
+			return fmt.Errorf("shard %s defined twice", shardConfig.Name)
+		}
+		names[shardConfig.Name] = true
+		if err := shardConfig.Validate(); err != nil {
+			return fmt.Errorf("shard %s: %s", shardConfig.Name, err)
+		}
+	}
+	return nil
+}
+
+// Writes the point to the shards owning its series
+func (ss *shardSink) Write(point *Point) error {
+	var lastErr error
+	for _, shard := range ss.ring.Lookup(point.Series(), ss.replicas) {
+		if err := ss.shards[shard].Write(point); err != nil {
+			atomic.AddUint64(&ss.failed[shard], 1)
+			lastErr = fmt.Errorf("shard %s: %s", ss.names[shard], err)
+		}
+	}
+	return lastErr
+}
+
+func (ss *shardSink) Flush() error {
+	var lastErr error
+	for i, shard := range ss.shards {
+		if err := shard.Flush(); err != nil {
+			lastErr = fmt.Errorf("shard %s: %s", ss.names[i], err)
+		}
+	}
+	return lastErr
+}
+
+func (ss *shardSink) Close() error {
+	var lastErr error
+	for i, shard := range ss.shards {
+		if err := shard.Close(); err != nil {
+			lastErr = fmt.Errorf("shard %s: %s", ss.names[i], err)
+		}
+	}
+	return lastErr
+}
+
+// Pings all shards able to, returning the last error
+func (ss *shardSink) Ping() error {
+	var lastErr error
+	for i, shard := range ss.shards {
+		if p, ok := shard.(Pinger); ok {
+			if err := p.Ping(); err != nil {
+				lastErr = fmt.Errorf("shard %s: %s", ss.names[i], err)
+			}
+		}
+	}
+	return lastErr
+}
+
+func (ss *shardSink) ReportErrors(report func(error)) {
+	for _, shard := range ss.shards {
+		if r, ok := shard.(ErrorReporter); ok {
+			r.ReportErrors(report)
+		}
+	}
+}
+
+func (ss *shardSink) Pause() {
+	for _, shard := range ss.shards {
+		if p, ok := shard.(Pauser); ok {
+			p.Pause()
+		}
+	}
+}
+
+func (ss *shardSink) Resume() {
+	for _, shard := range ss.shards {
+		if p, ok := shard.(Pauser); ok {
+			p.Resume()
+		}
+	}
+}
+
+// Aggregated statistics of all shards
+func (ss *shardSink) Stats() Stats {
+	var total Stats
+	for _, stats := range ss.BackendStats() {
+		total.Add(stats)
+	}
+	return total
+}
+
+// Statistics of each shard, by name
+func (ss *shardSink) BackendStats() map[string]Stats {
+	stats := make(map[string]Stats, len(ss.shards))
+	for i, shard := range ss.shards {
+		var s Stats
+		if r, ok := shard.(StatsReporter); ok {
+			s = r.Stats()
+		}
+		s.Failed += atomic.LoadUint64(&ss.failed[i])
+		stats[ss.names[i]] = s
+	}
+	return stats
+}
@@ -0,0 +1,159 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSinkClosed   = errors.New("timeseries: sink closed")
+	ErrNoFields     = errors.New("timeseries: point without fields")
+	ErrInvalidField = errors.New("timeseries: point with a NaN, infinite or out of range field")
+)
+
+// A Sink stores points in a time-series backend. Points may be shared with
+// other sinks, so sinks must not modify them.
+type Sink interface {
+	// Write buffers a point to be stored
+	Write(point *Point) error
+	// Flush stores all buffered points
+	Flush() error
+	// Close flushes buffered points and releases resources. The sink must not
+	// be used afterwards.
+	Close() error
+}
+
+type SinkConfiguration struct {
+	Name string // identifies the sink in logs and statistics
+	Type string // as registered with RegisterSink
+	// settings of the sinks shipped with metricas
+	InfluxDB *InfluxDBConfiguration
+	File     *FileConfiguration
+	Fanout   *FanoutConfiguration
+	Shard    *ShardConfiguration
+	// settings of any other sink
+	Options map[string]string
+}
+
+// Counters kept by sinks
+type Stats struct {
+	Written  uint64 // points stored
+	Failed   uint64 // points that could not be stored
+	Dropped  uint64 // points discarded before reaching the backend
+	Retries  uint64 // writes retried
+	Buffered uint64 // points waiting to be stored
+	// when the oldest point buffered by the sink was written to it, zero when
+	// there is none
+	OldestBuffered time.Time
+}
+
+// Merges the statistics of another sink into these
+func (s *Stats) Add(other Stats) {
+	s.Written += other.Written
+	s.Failed += other.Failed
+	s.Dropped += other.Dropped
+	s.Retries += other.Retries
+	s.Buffered += other.Buffered
+	if !other.OldestBuffered.IsZero() && (s.OldestBuffered.IsZero() || other.OldestBuffered.Before(s.OldestBuffered)) {
+		s.OldestBuffered = other.OldestBuffered
+	}
+}
+
+// Implemented by sinks keeping statistics
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// Implemented by sinks able to check their backends are reachable
+type Pinger interface {
+	Ping() error
+}
+
+// Implemented by sinks able to hold points instead of writing them, e.g. while
+// their backend is under maintenance. A paused sink buffers points until its
+// buffer is full and then blocks writers, until resumed. Flush and Close write
+// buffered points regardless.
+type Pauser interface {
+	Pause()
+	Resume()
+}
+
+// Implemented by sinks writing to several backends, with statistics by backend
+// name
+type BackendStatsReporter interface {
+	BackendStats() map[string]Stats
+}
+
+// Implemented by sinks failing in the background, e.g. when writing buffered
+// points, which they report to the given function instead of logging them. It
+// is called before the sink is written to, and must not block.
+type ErrorReporter interface {
+	ReportErrors(report func(error))
+}
+
+// Creates a sink from its configuration
+type SinkFactory func(config *SinkConfiguration) (Sink, error)
+
+var (
+	sinksMu sync.Mutex
+	sinks   = make(map[string]SinkFactory)
+)
+
+// Makes a sink type available to NewSink. It is meant to be called from the
+// init function of the package implementing the sink.
+func RegisterSink(sinkType string, factory SinkFactory) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	if _, dup := sinks[sinkType]; dup {
+		panic("timeseries: sink " + sinkType + " registered twice")
+	}
+	sinks[sinkType] = factory
+}
+
+// Creates a sink of the configured type
+func NewSink(config *SinkConfiguration) (Sink, error) {
+	sinksMu.Lock()
+	factory, ok := sinks[config.Type]
+	sinksMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type %q", config.Type)
+	}
+	return factory(config)
+}
+
+// Checks a sink configuration, and those of the sinks it writes to, filling in
+// defaults, without connecting to any backend
+func (config *SinkConfiguration) Validate() error {
+	sinksMu.Lock()
+	_, ok := sinks[config.Type]
+	sinksMu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown sink type %q", config.Type)
+	}
+	switch config.Type {
+	case SINK_INFLUXDB:
+		if config.InfluxDB == nil {
+			return errors.New("missing InfluxDB sink configuration")
+		}
+		return config.InfluxDB.validate()
+	case SINK_FILE:
+		if config.File == nil {
+			return errors.New("missing file sink configuration")
+		}
+		return config.File.validate()
+	case SINK_FANOUT:
+		if config.Fanout == nil {
+			return errors.New("missing fan-out sink configuration")
+		}
+		return config.Fanout.validate()
+	case SINK_SHARD:
+		if config.Shard == nil {
+			return errors.New("missing shard sink configuration")
+		}
+		return config.Shard.validate()
+	}
+	// other sinks are checked when created
+	return nil
+}